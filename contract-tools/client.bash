@@ -8,14 +8,13 @@ fi
 
 export CAR_FILE_PATH="$1.car"
 car create --output $CAR_FILE_PATH --version 1 $1
-export HASH_OUT=$(cat $CAR_FILE_PATH | stream-commp 2>&1)
 
-# Data Plane
-export BUFFER_ID=$(curl --silent -X POST -T $CAR_FILE_PATH "http://localhost:5077/put" | jq '.id')
-export BUFFER_ADDR="http://localhost:5077/get?id=$BUFFER_ID"
+# Data Plane, the buffer computes the CommP and padded size of the upload
+export PUT_OUT=$(curl --silent -X POST -T $CAR_FILE_PATH "http://localhost:5077/put")
+export BUFFER_ADDR=$(echo "$PUT_OUT" | jq -r '.url')
 
 # Control Plane
-export COMMP=$(echo "$HASH_OUT" | sed -nE 's/CommPCid: (.*)/\1/p')
-export SIZE=$(echo "$HASH_OUT" | sed -nE 's/Padded piece: *([0-9]+) bytes/\1/p')
+export COMMP=$(echo "$PUT_OUT" | jq -r '.commP')
+export SIZE=$(echo "$PUT_OUT" | jq -r '.size')
 echo "> xchain/xchain client offer $COMMP $SIZE $BUFFER_ADDR $2 $3 "
-xchain/xchain client offer $COMMP $SIZE "$BUFFER_ADDR" $2 $3 
\ No newline at end of file
+xchain/xchain client offer $COMMP $SIZE "$BUFFER_ADDR" $2 $3 
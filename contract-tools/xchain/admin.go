@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Default local address of the admin API
+const defaultAdminAddr = "127.0.0.1:1729"
+
+func (cfg *Config) adminAddr() string {
+	if cfg.AdminAddr == "" {
+		return defaultAdminAddr
+	}
+	return cfg.AdminAddr
+}
+
+// The admin API lets xchain commands act on a running daemon, which holds
+// the lock on the state store
+func (a *aggregator) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/deals/retry", a.retryHandler)
+	mux.HandleFunc("/deals/transfer-token", a.transferTokenHandler)
+	// Read-only views of the daemon's state
+	mux.Handle("/status", getHandler(a.statusHandler))
+	mux.Handle("/pending", getHandler(a.pendingHandler))
+	mux.Handle("/aggregates", getHandler(a.aggregatesHandler))
+	mux.HandleFunc("/transfer", a.transferStatusHandler)
+	mux.Handle("/deals", getHandler(a.dealsHandler))
+	mux.Handle("/offers/rejected", getHandler(a.rejectedHandler))
+	return mux
+}
+
+func (a *aggregator) retryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeAdmin(w, r, a.adminToken, "deals cannot be retried on request") {
+		return
+	}
+	ref := r.URL.Query().Get("aggregate")
+	if ref == "" {
+		http.Error(w, "aggregate is required", http.StatusBadRequest)
+		return
+	}
+	deals, err := a.retryAggregate(r.Context(), ref)
+	if err != nil && deals == nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := RetryResponse{}
+	for _, deal := range deals {
+		resp.Deals = append(resp.Deals, deal.redacted())
+	}
+	if err != nil {
+		log.Printf("[ERROR] manual retry of aggregate %s failed: %s", ref, err)
+		resp.Error = err.Error()
+	}
+	writeJSON(w, resp)
+}
+
+// RetryResponse lists an aggregate's deals after a manual retry
+type RetryResponse struct {
+	Deals []DealRecord `json:"deals"`
+	Error string       `json:"error,omitempty"` // set if too few providers accepted the aggregate
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write response: %s", err)
+	}
+}
+
+// Check a request carries the admin token, endpoints that need one are
+// disabled until AdminToken is configured
+func authorizeAdmin(w http.ResponseWriter, r *http.Request, adminToken, disabled string) bool {
+	if adminToken == "" {
+		http.Error(w, "AdminToken is not configured, "+disabled, http.StatusForbidden)
+		return false
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Call the admin API of the daemon running with cfg, decoding the JSON response into resp
+func adminRequest(ctx context.Context, cfg *Config, method, path string, resp interface{}) error {
+	return daemonRequest(ctx, cfg, cfg.adminAddr(), method, path, resp)
+}
+
+// Call an xchain daemon listening on addr with the admin token
+func daemonRequest(ctx context.Context, cfg *Config, addr, method, path string, resp interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	if cfg.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach xchain daemon at %s: %w", addr, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, msg)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// AdmissionPolicy decides which offers the aggregator accepts. Empty fields
+// do not restrict offers.
+type AdmissionPolicy struct {
+	// ERC20 token addresses offers may pay with
+	Tokens []string
+	// Minimum Amount per GiB of padded piece size by token address, in the token's base units
+	MinPricePerGiB map[string]string
+	MinPieceSize   uint64 // padded bytes
+	MaxPieceSize   uint64 // padded bytes
+	// URL schemes and hosts offer locations may point at, e.g. "https" and "buffer.example.com"
+	LocationSchemes []string
+	LocationHosts   []string
+	// Addresses whose offerData transactions are rejected
+	BlockedSenders []string
+}
+
+// Validated admission policy
+type admissionPolicy struct {
+	tokens   map[common.Address]bool
+	minPrice map[common.Address]*big.Int
+	minSize  uint64
+	maxSize  uint64
+	schemes  map[string]bool
+	hosts    map[string]bool
+	blocked  map[common.Address]bool
+}
+
+const gib = 1 << 30
+
+func parseAddress(s string) (common.Address, error) {
+	if !common.IsHexAddress(s) {
+		return common.Address{}, fmt.Errorf("invalid address %q", s)
+	}
+	return common.HexToAddress(s), nil
+}
+
+func (p AdmissionPolicy) validate() (*admissionPolicy, error) {
+	policy := &admissionPolicy{
+		tokens:   make(map[common.Address]bool),
+		minPrice: make(map[common.Address]*big.Int),
+		minSize:  p.MinPieceSize,
+		maxSize:  p.MaxPieceSize,
+		schemes:  make(map[string]bool),
+		hosts:    make(map[string]bool),
+		blocked:  make(map[common.Address]bool),
+	}
+	for _, s := range p.Tokens {
+		token, err := parseAddress(s)
+		if err != nil {
+			return nil, fmt.Errorf("admission tokens: %w", err)
+		}
+		policy.tokens[token] = true
+	}
+	for s, price := range p.MinPricePerGiB {
+		token, err := parseAddress(s)
+		if err != nil {
+			return nil, fmt.Errorf("admission min price: %w", err)
+		}
+		min, ok := new(big.Int).SetString(price, 10)
+		if !ok || min.Sign() < 0 {
+			return nil, fmt.Errorf("invalid min price per GiB %q for token %s", price, token)
+		}
+		policy.minPrice[token] = min
+	}
+	if p.MaxPieceSize != 0 && p.MinPieceSize > p.MaxPieceSize {
+		return nil, fmt.Errorf("min piece size %d exceeds max piece size %d", p.MinPieceSize, p.MaxPieceSize)
+	}
+	for _, scheme := range p.LocationSchemes {
+		policy.schemes[strings.ToLower(scheme)] = true
+	}
+	for _, host := range p.LocationHosts {
+		policy.hosts[strings.ToLower(host)] = true
+	}
+	for _, s := range p.BlockedSenders {
+		sender, err := parseAddress(s)
+		if err != nil {
+			return nil, fmt.Errorf("admission blocked senders: %w", err)
+		}
+		policy.blocked[sender] = true
+	}
+	return policy, nil
+}
+
+// Reports why the policy rejects an offer, nil if it is admitted
+func (p *admissionPolicy) admit(offer Offer, sender common.Address) error {
+	if p.blocked[sender] {
+		return fmt.Errorf("sender %s is blocked", sender)
+	}
+	if len(p.tokens) > 0 && !p.tokens[offer.Token] {
+		return fmt.Errorf("token %s is not accepted", offer.Token)
+	}
+	if p.minSize != 0 && offer.Size < p.minSize {
+		return fmt.Errorf("size %d is below the minimum %d", offer.Size, p.minSize)
+	}
+	if p.maxSize != 0 && offer.Size > p.maxSize {
+		return fmt.Errorf("size %d exceeds the maximum %d", offer.Size, p.maxSize)
+	}
+	if min, ok := p.minPrice[offer.Token]; ok {
+		// amount / (size / GiB) >= min without losing precision
+		amount := new(big.Int)
+		if offer.Amount != nil {
+			amount.Mul(offer.Amount, big.NewInt(gib))
+		}
+		required := new(big.Int).Mul(min, new(big.Int).SetUint64(offer.Size))
+		if amount.Cmp(required) < 0 {
+			return fmt.Errorf("amount %s is below the minimum price of %s per GiB", offer.Amount, min)
+		}
+	}
+	if len(p.schemes) > 0 || len(p.hosts) > 0 {
+		u, err := url.Parse(offer.Location)
+		if err != nil {
+			return fmt.Errorf("invalid location %q: %w", offer.Location, err)
+		}
+		if len(p.schemes) > 0 && !p.schemes[strings.ToLower(u.Scheme)] {
+			return fmt.Errorf("location scheme %q is not allowed", u.Scheme)
+		}
+		if len(p.hosts) > 0 && !p.hosts[strings.ToLower(u.Hostname())] {
+			return fmt.Errorf("location host %q is not allowed", u.Hostname())
+		}
+	}
+	return nil
+}
+
+// Address that sent the transaction emitting a DataReady log, only looked
+// up when the policy blocks senders
+func (a *aggregator) offerSender(ctx context.Context, vLog types.Log) (common.Address, error) {
+	if len(a.admission.blocked) == 0 {
+		return common.Address{}, nil
+	}
+	tx, _, err := a.client.TransactionByHash(ctx, vLog.TxHash)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("failed to get transaction %s: %w", vLog.TxHash, err)
+	}
+	return a.client.TransactionSender(ctx, tx, vLog.BlockHash, vLog.TxIndex)
+}
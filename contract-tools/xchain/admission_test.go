@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmissionPolicy(t *testing.T) {
+	usdc := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	other := common.HexToAddress("0x2222222222222222222222222222222222222222")
+	spammer := common.HexToAddress("0x3333333333333333333333333333333333333333")
+	policy, err := AdmissionPolicy{
+		Tokens:          []string{usdc.Hex()},
+		MinPricePerGiB:  map[string]string{usdc.Hex(): "1000"},
+		MinPieceSize:    1 << 20,
+		MaxPieceSize:    1 << 30,
+		LocationSchemes: []string{"https"},
+		LocationHosts:   []string{"buffer.example.com"},
+		BlockedSenders:  []string{spammer.Hex()},
+	}.validate()
+	require.NoError(t, err)
+
+	valid := Offer{Size: 1 << 29, Location: "https://buffer.example.com/piece", Amount: big.NewInt(500), Token: usdc}
+	assert.NoError(t, policy.admit(valid, other))
+
+	for name, tc := range map[string]struct {
+		change func(o *Offer)
+		sender common.Address
+	}{
+		"blocked sender": {sender: spammer},
+		"token":          {change: func(o *Offer) { o.Token = other }},
+		"too small":      {change: func(o *Offer) { o.Size = 1 << 19 }},
+		"too big":        {change: func(o *Offer) { o.Size = 1 << 31 }},
+		"underpaid":      {change: func(o *Offer) { o.Amount = big.NewInt(499) }},
+		"no amount":      {change: func(o *Offer) { o.Amount = nil }},
+		"scheme":         {change: func(o *Offer) { o.Location = "http://buffer.example.com/piece" }},
+		"host":           {change: func(o *Offer) { o.Location = "https://evil.example.com/piece" }},
+	} {
+		t.Run(name, func(t *testing.T) {
+			offer := valid
+			if tc.change != nil {
+				tc.change(&offer)
+			}
+			assert.Error(t, policy.admit(offer, tc.sender))
+		})
+	}
+
+	// An empty policy admits everything
+	open, err := AdmissionPolicy{}.validate()
+	require.NoError(t, err)
+	assert.NoError(t, open.admit(Offer{Location: "ftp://anywhere"}, spammer))
+
+	_, err = AdmissionPolicy{Tokens: []string{"usdc"}}.validate()
+	assert.Error(t, err)
+	_, err = AdmissionPolicy{MinPricePerGiB: map[string]string{usdc.Hex(): "-1"}}.validate()
+	assert.Error(t, err)
+	_, err = AdmissionPolicy{MinPieceSize: 2, MaxPieceSize: 1}.validate()
+	assert.Error(t, err)
+}
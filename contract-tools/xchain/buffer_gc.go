@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ipfs/go-cid"
+)
+
+// Default time between buffer garbage collections
+const defaultBufferGCInterval = time.Hour
+
+func (cfg *Config) bufferGCInterval() time.Duration {
+	if cfg.BufferGCInterval == 0 {
+		return defaultBufferGCInterval
+	}
+	return time.Duration(cfg.BufferGCInterval) * time.Second
+}
+
+// Read the OnRamp contract configured in cfg
+func newOnRampReader(cfg *Config) (*contractOnRamp, error) {
+	client, err := ethclient.Dial(cfg.Api)
+	if err != nil {
+		return nil, err
+	}
+	parsedABI, err := LoadAbi(cfg.OnRampABIPath)
+	if err != nil {
+		return nil, err
+	}
+	address := common.HexToAddress(cfg.OnRampAddress)
+	contract := bind.NewBoundContract(address, *parsedABI, client, client, client)
+	return &contractOnRamp{address: address, contract: contract}, nil
+}
+
+// onRampReader reads the OnRamp contract state buffer GC decides on
+type onRampReader interface {
+	// Address of the contract
+	Address() common.Address
+	// Offer with the given ID, nil once past the last offer
+	Offer(ctx context.Context, offerID uint64) (*Offer, error)
+	// IDs of the offers in an aggregate, nil once past the last aggregate
+	AggregationOffers(ctx context.Context, aggID uint64) ([]uint64, error)
+	// Whether the storage of an aggregate has been proven
+	Proven(ctx context.Context, aggID uint64) (bool, error)
+}
+
+// contractOnRamp reads the OnRamp contract's public getters
+type contractOnRamp struct {
+	address  common.Address
+	contract *bind.BoundContract
+}
+
+func (c *contractOnRamp) Address() common.Address {
+	return c.address
+}
+
+func (c *contractOnRamp) Offer(ctx context.Context, offerID uint64) (*Offer, error) {
+	var out []interface{}
+	if err := c.contract.Call(&bind.CallOpts{Context: ctx}, &out, "offers", offerID); err != nil {
+		return nil, fmt.Errorf("failed to read offer %d: %w", offerID, err)
+	}
+	if len(out) < 5 {
+		return nil, fmt.Errorf("unexpected number of offer fields: got %d, want at least 5", len(out))
+	}
+	commP, _ := out[0].([]byte)
+	if len(commP) == 0 {
+		// Mappings return zero values for IDs that were never offered
+		return nil, nil
+	}
+	size, _ := out[1].(uint64)
+	location, _ := out[2].(string)
+	amount, _ := out[3].(*big.Int)
+	token, _ := out[4].(common.Address)
+	return &Offer{CommP: commP, Size: size, Location: location, Amount: amount, Token: token}, nil
+}
+
+func (c *contractOnRamp) AggregationOffers(ctx context.Context, aggID uint64) ([]uint64, error) {
+	var offerIDs []uint64
+	for i := int64(0); ; i++ {
+		var out []interface{}
+		// Reading past the end of the array reverts, which is how its length is found
+		if err := c.contract.Call(&bind.CallOpts{Context: ctx}, &out, "aggregations", aggID, big.NewInt(i)); err != nil {
+			if isRevert(err) {
+				return offerIDs, nil
+			}
+			// Anything else may cut the aggregate short
+			return nil, fmt.Errorf("failed to read offer %d of aggregate %d: %w", i, aggID, err)
+		}
+		id, ok := out[0].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("invalid type for offer ID, expected uint64, got %T", out[0])
+		}
+		offerIDs = append(offerIDs, id)
+	}
+}
+
+// JSON-RPC error code of eth_call executions that revert
+const rpcExecutionReverted = 3
+
+// Whether a contract call failed because execution reverted, rather than
+// because the node could not be reached or the call could not be made
+func isRevert(err error) bool {
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == rpcExecutionReverted {
+		return true
+	}
+	// Lotus before the standard error code reports the revert in the message
+	return strings.Contains(err.Error(), "revert")
+}
+
+func (c *contractOnRamp) Proven(ctx context.Context, aggID uint64) (bool, error) {
+	var out []interface{}
+	if err := c.contract.Call(&bind.CallOpts{Context: ctx}, &out, "provenAggregations", aggID); err != nil {
+		return false, fmt.Errorf("failed to read proof status of aggregate %d: %w", aggID, err)
+	}
+	proven, _ := out[0].(bool)
+	return proven, nil
+}
+
+// BufferGCResult lists the buffered files a collection removed, or would
+// remove in a dry run, and why
+type BufferGCResult struct {
+	Removed []BufferGCFile `json:"removed"`
+	Kept    int            `json:"kept"`
+	DryRun  bool           `json:"dryRun"`
+}
+
+type BufferGCFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// Key of the buffered file an offer refers to: piece_<commP> files are
+// matched by CommP, data_<id> files written by older versions by location
+func offerBufferKeys(offer *Offer) []string {
+	var keys []string
+	if _, c, err := cid.CidFromBytes(offer.CommP); err == nil {
+		keys = append(keys, "piece_"+c.String())
+	}
+	if u, err := url.Parse(offer.Location); err == nil && u.Path == "/get" {
+		if id, err := strconv.Atoi(u.Query().Get("id")); err == nil {
+			keys = append(keys, fmt.Sprintf("data_%d", id))
+		}
+	}
+	return keys
+}
+
+// bufferGCState is what collections have read from the OnRamp contract so
+// far. Offers and aggregates never change once created, so it is kept in the
+// buffer directory and each collection only reads what was added since, and
+// whether the aggregates not yet proven are now.
+type bufferGCState struct {
+	OnRamp     common.Address      // contract the state was read from
+	Offers     uint64              // offers up to this ID were read
+	Refs       map[string][]uint64 // offers referencing each buffered file
+	Aggregates uint64              // aggregates up to this ID were read
+	Unproven   map[uint64][]uint64 // offers of aggregates that were not proven yet
+	Proven     map[uint64]bool     // offers in proven aggregates
+}
+
+// File in the buffer directory the collection state is kept in
+const bufferGCStateFile = "gc-state.json"
+
+// Load the state the last collection read from onramp, starting over
+// without one
+func (s *BufferHTTPService) loadGCState(onramp common.Address) *bufferGCState {
+	state := &bufferGCState{}
+	data, err := os.ReadFile(filepath.Join(s.basePath, bufferGCStateFile))
+	if err == nil {
+		err = json.Unmarshal(data, state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[ERROR] failed to load buffer gc state, scanning the whole contract: %s", err)
+		state = &bufferGCState{}
+	}
+	if state.OnRamp != onramp {
+		// Offer and aggregate IDs start over with a new contract
+		state = &bufferGCState{OnRamp: onramp}
+	}
+	if state.Refs == nil {
+		state.Refs = make(map[string][]uint64)
+	}
+	if state.Unproven == nil {
+		state.Unproven = make(map[uint64][]uint64)
+	}
+	if state.Proven == nil {
+		state.Proven = make(map[uint64]bool)
+	}
+	return state
+}
+
+func (s *BufferHTTPService) saveGCState(state *bufferGCState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Written aside and renamed so a crash never leaves half a state
+	path := filepath.Join(s.basePath, bufferGCStateFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write buffer gc state: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Read the offers and aggregates added to the contract since the last
+// collection, and check whether the aggregates not proven then are now
+func (state *bufferGCState) update(ctx context.Context, onramp onRampReader) error {
+	// Which offers reference which files
+	for id := state.Offers + 1; ; id++ {
+		offer, err := onramp.Offer(ctx, id)
+		if err != nil {
+			// Without every offer, never offered data can't be told apart
+			return err
+		}
+		if offer == nil {
+			break
+		}
+		for _, key := range offerBufferKeys(offer) {
+			state.Refs[key] = append(state.Refs[key], id)
+		}
+		state.Offers = id
+	}
+
+	// Offers whose aggregate is proven
+	for aggID := state.Aggregates + 1; ; aggID++ {
+		offerIDs, err := onramp.AggregationOffers(ctx, aggID)
+		if err != nil {
+			return err
+		}
+		if len(offerIDs) == 0 {
+			break
+		}
+		state.Unproven[aggID] = offerIDs
+		state.Aggregates = aggID
+	}
+	for aggID, offerIDs := range state.Unproven {
+		ok, err := onramp.Proven(ctx, aggID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			for _, id := range offerIDs {
+				state.Proven[id] = true
+			}
+			delete(state.Unproven, aggID)
+		}
+	}
+	return nil
+}
+
+// Remove buffered data once every offer for it is in an aggregate whose
+// storage has been proven on chain, and uploads never offered within ttl
+// (0 keeps them forever). Only the contract state added since the last run
+// and the aggregates not proven yet are read, see bufferGCState.
+func (s *BufferHTTPService) GC(ctx context.Context, onramp onRampReader, ttl time.Duration, dryRun bool) (*BufferGCResult, error) {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+	started := time.Now()
+
+	state := s.loadGCState(onramp.Address())
+	if err := state.update(ctx, onramp); err != nil {
+		return nil, err
+	}
+	if err := s.saveGCState(state); err != nil {
+		return nil, err
+	}
+	refs, proven := state.Refs, state.Proven
+
+	entries, err := os.ReadDir(s.basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read buffer directory: %w", err)
+	}
+	result := &BufferGCResult{DryRun: dryRun}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "piece_") && !strings.HasPrefix(name, "data_") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		reason := ""
+		if offerIDs, ok := refs[name]; ok {
+			allProven := true
+			for _, id := range offerIDs {
+				allProven = allProven && proven[id]
+			}
+			if allProven {
+				reason = fmt.Sprintf("offers %v are in proven aggregates", offerIDs)
+			}
+		} else if ttl > 0 && started.Sub(info.ModTime()) > ttl {
+			reason = fmt.Sprintf("never offered within %s", ttl)
+		}
+		if reason == "" {
+			result.Kept++
+			continue
+		}
+		if !dryRun {
+			removed, err := s.remove(name, started)
+			if err != nil {
+				return result, err
+			}
+			if !removed {
+				result.Kept++
+				continue
+			}
+		}
+		result.Removed = append(result.Removed, BufferGCFile{Name: name, Size: info.Size(), Reason: reason})
+	}
+	return result, nil
+}
+
+// Remove a buffered file unless it was uploaded again after the scan started
+func (s *BufferHTTPService) remove(name string, scanned time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := filepath.Join(s.basePath, name)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if info.ModTime().After(scanned) {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+	bufferDiskBytes.Sub(float64(info.Size()))
+	return true, nil
+}
+
+// Run a collection on request of `xchain buffer gc`. Collections run in the
+// buffer daemon so they never race its uploads. onramp is nil when the
+// contract to check offers against is not configured.
+func (s *BufferHTTPService) GCHandler(onramp onRampReader, ttl time.Duration, dryRun bool, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeAdmin(w, r, adminToken, "buffer gc cannot be run on request") {
+			return
+		}
+		if onramp == nil {
+			http.Error(w, "buffer gc needs Api and OnRampAddress to be configured", http.StatusServiceUnavailable)
+			return
+		}
+		result, err := s.GC(r.Context(), onramp, ttl, dryRun || r.URL.Query().Get("dry-run") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, result)
+	}
+}
+
+// Run buffer GC every interval until ctx is done
+func (s *BufferHTTPService) runGC(ctx context.Context, onramp onRampReader, interval, ttl time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		result, err := s.GC(ctx, onramp, ttl, dryRun)
+		if err != nil {
+			log.Printf("[ERROR] buffer gc failed: %s", err)
+			continue
+		}
+		for _, f := range result.Removed {
+			if dryRun {
+				log.Printf("buffer gc would remove %s (%d bytes): %s", f.Name, f.Size, f.Reason)
+			} else {
+				log.Printf("buffer gc removed %s (%d bytes): %s", f.Name, f.Size, f.Reason)
+			}
+		}
+	}
+}
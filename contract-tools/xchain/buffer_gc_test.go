@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOnRamp holds contract state in memory, offer and aggregate IDs start at 1
+type fakeOnRamp struct {
+	address      common.Address
+	offers       []*Offer
+	aggregations [][]uint64
+	proven       map[uint64]bool
+	offerReads   []uint64 // IDs of the offers read
+}
+
+func (f *fakeOnRamp) Address() common.Address {
+	return f.address
+}
+
+func (f *fakeOnRamp) Offer(ctx context.Context, offerID uint64) (*Offer, error) {
+	f.offerReads = append(f.offerReads, offerID)
+	if offerID > uint64(len(f.offers)) {
+		return nil, nil
+	}
+	return f.offers[offerID-1], nil
+}
+
+func (f *fakeOnRamp) AggregationOffers(ctx context.Context, aggID uint64) ([]uint64, error) {
+	if aggID > uint64(len(f.aggregations)) {
+		return nil, nil
+	}
+	return f.aggregations[aggID-1], nil
+}
+
+func (f *fakeOnRamp) Proven(ctx context.Context, aggID uint64) (bool, error) {
+	return f.proven[aggID], nil
+}
+
+func testOffer(t *testing.T, resp PutResponse) *Offer {
+	commP, err := cid.Parse(resp.CommP)
+	require.NoError(t, err)
+	return &Offer{CommP: commP.Bytes(), Size: resp.Size, Location: resp.URL}
+}
+
+func TestBufferGC(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewBufferHTTPService(dir)
+	require.NoError(t, err)
+
+	proven := testPut(t, s, []byte("in a proven aggregate"))
+	unproven := testPut(t, s, []byte("in an unproven aggregate"))
+	pending := testPut(t, s, []byte("offered but not aggregated"))
+	stale := testPut(t, s, []byte("never offered"))
+	fresh := testPut(t, s, []byte("recently uploaded"))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "data_3"), []byte("legacy"), 0644))
+	old := time.Now().Add(-2 * time.Hour)
+	for _, resp := range []PutResponse{proven, unproven, pending, stale} {
+		require.NoError(t, os.Chtimes(filepath.Join(dir, "piece_"+resp.CommP), old, old))
+	}
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "data_3"), old, old))
+
+	onramp := &fakeOnRamp{
+		offers: []*Offer{
+			testOffer(t, proven),
+			testOffer(t, unproven),
+			{Location: "http://buffer.test/get?id=3"},
+			testOffer(t, pending),
+		},
+		aggregations: [][]uint64{{1, 3}, {2}},
+		proven:       map[uint64]bool{1: true},
+	}
+
+	// Dry runs only report
+	result, err := s.GC(context.Background(), onramp, time.Hour, true)
+	require.NoError(t, err)
+	assert.True(t, result.DryRun)
+	assert.Len(t, result.Removed, 3)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 7) // and the gc state
+
+	result, err = s.GC(context.Background(), onramp, time.Hour, false)
+	require.NoError(t, err)
+	var removed []string
+	for _, f := range result.Removed {
+		removed = append(removed, f.Name)
+	}
+	assert.ElementsMatch(t, []string{"piece_" + proven.CommP, "piece_" + stale.CommP, "data_3"}, removed)
+	assert.Equal(t, 3, result.Kept)
+	for _, resp := range []PutResponse{unproven, pending, fresh} {
+		assert.FileExists(t, filepath.Join(dir, "piece_"+resp.CommP))
+	}
+
+	// Without a TTL uploads that were never offered are kept forever
+	stale = testPut(t, s, []byte("never offered"))
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "piece_"+stale.CommP), old, old))
+	result, err = s.GC(context.Background(), onramp, 0, false)
+	require.NoError(t, err)
+	assert.Empty(t, result.Removed)
+}
+
+func TestBufferGCReadsOnlyNewState(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewBufferHTTPService(dir)
+	require.NoError(t, err)
+	first := testPut(t, s, []byte("first offer"))
+	onramp := &fakeOnRamp{
+		offers:       []*Offer{testOffer(t, first)},
+		aggregations: [][]uint64{{1}},
+		proven:       map[uint64]bool{},
+	}
+	result, err := s.GC(context.Background(), onramp, 0, false)
+	require.NoError(t, err)
+	assert.Empty(t, result.Removed)
+	assert.Equal(t, []uint64{1, 2}, onramp.offerReads)
+
+	// After a restart only the new offer is read, and the aggregate that
+	// was not proven before is checked again
+	second := testPut(t, s, []byte("second offer"))
+	onramp.offers = append(onramp.offers, testOffer(t, second))
+	onramp.proven[1] = true
+	onramp.offerReads = nil
+	s, err = NewBufferHTTPService(dir)
+	require.NoError(t, err)
+	result, err = s.GC(context.Background(), onramp, 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2, 3}, onramp.offerReads)
+	require.Len(t, result.Removed, 1)
+	assert.Equal(t, "piece_"+first.CommP, result.Removed[0].Name)
+	assert.FileExists(t, filepath.Join(dir, "piece_"+second.CommP))
+
+	// A new contract is read from its first offer
+	redeployed := &fakeOnRamp{address: common.HexToAddress("0x1111111111111111111111111111111111111111")}
+	_, err = s.GC(context.Background(), redeployed, 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1}, redeployed.offerReads)
+}
+
+func TestBufferGCKeepsReuploads(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewBufferHTTPService(dir)
+	require.NoError(t, err)
+	resp := testPut(t, s, []byte("uploaded twice"))
+	path := filepath.Join(dir, "piece_"+resp.CommP)
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(path, old, old))
+
+	// Uploading the same data again restarts its TTL
+	testPut(t, s, []byte("uploaded twice"))
+	result, err := s.GC(context.Background(), &fakeOnRamp{}, time.Hour, false)
+	require.NoError(t, err)
+	assert.Empty(t, result.Removed)
+	assert.FileExists(t, path)
+
+	// and so does an upload that lands after a collection scanned the contract
+	require.NoError(t, os.Chtimes(path, old, old))
+	removed, err := s.remove("piece_"+resp.CommP, old.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.False(t, removed)
+	assert.FileExists(t, path)
+}
+
+func TestBufferGCHandler(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewBufferHTTPService(dir)
+	require.NoError(t, err)
+	proven := testPut(t, s, []byte("in a proven aggregate"))
+	onramp := &fakeOnRamp{
+		offers:       []*Offer{testOffer(t, proven)},
+		aggregations: [][]uint64{{1}},
+		proven:       map[uint64]bool{1: true},
+	}
+	gc := func(h http.HandlerFunc, token, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "http://buffer.test/gc"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusForbidden, gc(s.GCHandler(onramp, 0, false, ""), "", "").Code)
+	h := s.GCHandler(onramp, 0, false, "admin-secret")
+	assert.Equal(t, http.StatusUnauthorized, gc(h, "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, gc(h, "wrong", "").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, gc(s.GCHandler(nil, 0, false, "admin-secret"), "admin-secret", "").Code)
+
+	rec := gc(h, "admin-secret", "?dry-run=true")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var result BufferGCResult
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.True(t, result.DryRun)
+	assert.Len(t, result.Removed, 1)
+	assert.FileExists(t, filepath.Join(dir, "piece_"+proven.CommP))
+
+	rec = gc(h, "admin-secret", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.NoFileExists(t, filepath.Join(dir, "piece_"+proven.CommP))
+}
+
+// rpcError is a JSON-RPC error as returned by an eth_call
+type rpcError struct {
+	code int
+	msg  string
+}
+
+func (e rpcError) Error() string  { return e.msg }
+func (e rpcError) ErrorCode() int { return e.code }
+
+// fakeCaller serves the aggregations getter of an aggregate with n offers,
+// reverting past the end and failing with err at index failAt
+type fakeCaller struct {
+	abi    abi.ABI
+	n      int64
+	failAt int64
+	err    error
+}
+
+func (f *fakeCaller) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	return []byte{1}, nil
+}
+
+func (f *fakeCaller) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	args, err := f.abi.Methods["aggregations"].Inputs.Unpack(call.Data[4:])
+	if err != nil {
+		return nil, err
+	}
+	i := args[1].(*big.Int).Int64()
+	if i == f.failAt {
+		return nil, f.err
+	}
+	if i >= f.n {
+		return nil, rpcError{code: rpcExecutionReverted, msg: "execution reverted"}
+	}
+	return f.abi.Methods["aggregations"].Outputs.Pack(uint64(100 + i))
+}
+
+func TestAggregationOffersStopsOnlyAtRevert(t *testing.T) {
+	parsed, err := abi.JSON(strings.NewReader(`[{"type":"function","name":"aggregations","stateMutability":"view",
+		"inputs":[{"name":"","type":"uint64"},{"name":"","type":"uint256"}],
+		"outputs":[{"name":"","type":"uint64"}]}]`))
+	require.NoError(t, err)
+	onramp := func(caller *fakeCaller) *contractOnRamp {
+		caller.abi = parsed
+		return &contractOnRamp{contract: bind.NewBoundContract(common.Address{}, parsed, caller, nil, nil)}
+	}
+
+	offerIDs, err := onramp(&fakeCaller{n: 3, failAt: -1}).AggregationOffers(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{100, 101, 102}, offerIDs)
+
+	// Older Lotus reports reverts only in the message
+	legacy := errors.New("message execution failed (exit=[33], revert reason=[none], vm error=[none])")
+	offerIDs, err = onramp(&fakeCaller{n: 2, failAt: 2, err: legacy}).AggregationOffers(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{100, 101}, offerIDs)
+
+	// A node that cannot be reached must not look like the end of the aggregate
+	_, err = onramp(&fakeCaller{n: 3, failAt: 1, err: errors.New("connection refused")}).AggregationOffers(context.Background(), 1)
+	assert.ErrorContains(t, err, "connection refused")
+}
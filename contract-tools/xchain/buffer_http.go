@@ -6,17 +6,29 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-
-	"github.com/mitchellh/go-homedir"
-
 	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/mitchellh/go-homedir"
 )
 
+// Buffered data is stored by piece CID so locations are self-verifying and
+// uploads can never overwrite other data. data_<id> files written by older
+// versions are still served at /get?id=<id>.
 type BufferHTTPService struct {
 	basePath string
-	nextID   int
-	mu       sync.Mutex
+	mu       sync.Mutex // serializes moving finished uploads into place
+	gcMu     sync.Mutex // one garbage collection at a time
+}
+
+// PutResponse describes data stored by the buffer, ready to be offered
+type PutResponse struct {
+	CommP string `json:"commP"`
+	Size  uint64 `json:"size"` // padded piece size
+	URL   string `json:"url"`
 }
 
 func NewBufferHTTPService(basePath string) (*BufferHTTPService, error) {
@@ -24,43 +36,158 @@ func NewBufferHTTPService(basePath string) (*BufferHTTPService, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return nil, err
+	}
+	// Account for data stored before a restart
+	var used int64
+	entries, _ := os.ReadDir(path)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			// Left over from an upload interrupted by a crash
+			os.Remove(filepath.Join(path, entry.Name()))
+			continue
+		}
+		if entry.Name() == bufferGCStateFile {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && !info.IsDir() {
+			used += info.Size()
+		}
+	}
+	bufferDiskBytes.Set(float64(used))
 	return &BufferHTTPService{
 		basePath: path,
-		nextID:   1,
 	}, nil
 }
 
+func (s *BufferHTTPService) piecePath(commP cid.Cid) string {
+	return filepath.Join(s.basePath, "piece_"+commP.String())
+}
+
+// Store uploaded data by its CommP, computed while the upload streams to disk.
+// Uploads stream into their own temp file without holding the lock, so slow
+// clients don't block each other, and are only renamed into place once
+// complete and synced. Partial uploads, e.g. from clients that disconnect,
+// are removed.
 func (s *BufferHTTPService) PutHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
 		return
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	filePath := filepath.Join(s.basePath, fmt.Sprintf("data_%d", s.nextID))
-	file, err := os.Create(filePath)
+	// CreateTemp picks a unique name atomically
+	file, err := os.CreateTemp(s.basePath, "upload_*.tmp")
 	if err != nil {
 		http.Error(w, fmt.Errorf("failed to create file %w", err).Error(), http.StatusInternalServerError)
 		return
 	}
+	defer os.Remove(file.Name())
 	defer file.Close()
 
-	_, err = io.Copy(file, r.Body)
+	commp := &commpWriter{}
+	defer commp.Close()
+	n, err := io.Copy(io.MultiWriter(file, commp), r.Body)
 	if err != nil {
 		http.Error(w, "Failed to write data", http.StatusInternalServerError)
 		return
 	}
+	if n == 0 {
+		http.Error(w, "No data", http.StatusBadRequest)
+		return
+	}
+	size := paddedPieceSize(uint64(n))
+	commP, err := commp.Sum(size)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to compute CommP: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if err := file.Sync(); err != nil {
+		http.Error(w, "Failed to write data", http.StatusInternalServerError)
+		return
+	}
+	if err := file.Close(); err != nil {
+		http.Error(w, "Failed to write data", http.StatusInternalServerError)
+		return
+	}
+	if err := s.publish(file.Name(), commP, n); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store data: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	writeJSON(w, PutResponse{
+		CommP: commP.String(),
+		Size:  uint64(size),
+		URL:   fmt.Sprintf("%s://%s/piece/%s", scheme, r.Host, commP),
+	})
+}
+
+// Move a finished upload into place under its CommP
+func (s *BufferHTTPService) publish(tmp string, commP cid.Cid, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Identical data is already stored under the same name, restart its
+	// retention period as it is about to be offered again
+	if _, err := os.Stat(s.piecePath(commP)); err == nil {
+		now := time.Now()
+		return os.Chtimes(s.piecePath(commP), now, now)
+	}
+	if err := os.Rename(tmp, s.piecePath(commP)); err != nil {
+		return err
+	}
+	// Make the rename itself durable
+	if dir, err := os.Open(s.basePath); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	bufferDiskBytes.Add(float64(size))
+	return nil
+}
 
-	id := s.nextID
-	s.nextID++
+// Serve data by CommP at /piece/<commP>. The CommP is a strong ETag as it
+// commits to every byte of the data.
+func (s *BufferHTTPService) PieceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	commP, err := cid.Parse(strings.TrimPrefix(r.URL.Path, "/piece/"))
+	if err != nil {
+		http.Error(w, "Invalid CommP", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("ETag", `"`+commP.String()+`"`)
+	serveFile(w, r, s.piecePath(commP))
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("{\"id\": %d}", id)))
+// Serve a stored file with HEAD, Range and conditional request support
+func serveFile(w http.ResponseWriter, r *http.Request, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		w.Header().Del("ETag")
+		http.Error(w, "No data found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to read data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), file)
 }
 
+// Serve data stored by numeric ID at /get?id=<id>
 func (s *BufferHTTPService) GetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
 	idStr := r.URL.Query().Get("id")
 	if idStr == "" {
 		http.Error(w, "ID is required", http.StatusBadRequest)
@@ -73,13 +200,5 @@ func (s *BufferHTTPService) GetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath := filepath.Join(s.basePath, fmt.Sprintf("data_%d", id))
-	file, err := os.Open(filePath)
-	if err != nil {
-		http.Error(w, "No data found", http.StatusNotFound)
-		return
-	}
-	defer file.Close()
-
-	io.Copy(w, file)
+	serveFile(w, r, filepath.Join(s.basePath, fmt.Sprintf("data_%d", id)))
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPut(t *testing.T, s *BufferHTTPService, data []byte) PutResponse {
+	rec := httptest.NewRecorder()
+	s.PutHandler(rec, httptest.NewRequest(http.MethodPost, "http://buffer.test/put", bytes.NewReader(data)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp PutResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return resp
+}
+
+func testGet(t *testing.T, h http.HandlerFunc, url string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	return rec
+}
+
+func TestBufferStoresByCommP(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewBufferHTTPService(dir)
+	require.NoError(t, err)
+
+	data := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(data)
+	resp := testPut(t, s, data)
+	assert.Equal(t, uint64(4096), resp.Size)
+	expected := testPieceCID(t, data, filabi.PaddedPieceSize(resp.Size))
+	assert.Equal(t, expected.String(), resp.CommP)
+	assert.Equal(t, "http://buffer.test/piece/"+resp.CommP, resp.URL)
+
+	rec := testGet(t, s.PieceHandler, resp.URL)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, data, rec.Body.Bytes())
+
+	// Uploading the same data again stores it once
+	assert.Equal(t, resp, testPut(t, s, data))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	assert.Equal(t, http.StatusNotFound, testGet(t, s.PieceHandler, "/piece/"+prefixCARCid).Code)
+	assert.Equal(t, http.StatusBadRequest, testGet(t, s.PieceHandler, "/piece/../data_1").Code)
+	rec = httptest.NewRecorder()
+	s.PutHandler(rec, httptest.NewRequest(http.MethodPost, "/put", bytes.NewReader(nil)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestBufferServesLegacyData(t *testing.T) {
+	dir := t.TempDir()
+	// Data stored by numeric ID before the buffer was content addressed
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "data_7"), []byte("legacy"), 0644))
+	// and an upload interrupted by a crash
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "upload_1.tmp"), []byte("partial"), 0644))
+	s, err := NewBufferHTTPService(dir)
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(dir, "upload_1.tmp"))
+
+	rec := testGet(t, s.GetHandler, "/get?id=7")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "legacy", rec.Body.String())
+	assert.Equal(t, http.StatusNotFound, testGet(t, s.GetHandler, "/get?id=8").Code)
+}
+
+func TestPaddedPieceSize(t *testing.T) {
+	assert.Equal(t, filabi.PaddedPieceSize(128), paddedPieceSize(1))
+	assert.Equal(t, filabi.PaddedPieceSize(128), paddedPieceSize(127))
+	assert.Equal(t, filabi.PaddedPieceSize(256), paddedPieceSize(128))
+	assert.Equal(t, filabi.PaddedPieceSize(1<<20), paddedPieceSize(uint64(filabi.PaddedPieceSize(1<<20).Unpadded())))
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("client disconnected")
+}
+
+func TestBufferConcurrentUploads(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewBufferHTTPService(dir)
+	require.NoError(t, err)
+
+	// A slow upload that has only sent part of its body
+	slow, slowWriter := io.Pipe()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.PutHandler(rec, httptest.NewRequest(http.MethodPost, "/put", slow))
+		done <- rec
+	}()
+	_, err = slowWriter.Write([]byte("slow start "))
+	require.NoError(t, err)
+
+	// does not hold up other uploads
+	fast := testPut(t, s, []byte("fast"))
+	assert.Equal(t, http.StatusOK, testGet(t, s.PieceHandler, fast.URL).Code)
+
+	_, err = slowWriter.Write([]byte("and end"))
+	require.NoError(t, err)
+	slowWriter.Close()
+	rec := <-done
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp PutResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "slow start and end", testGet(t, s.PieceHandler, resp.URL).Body.String())
+
+	// Partial uploads are cleaned up when the client goes away
+	rec = httptest.NewRecorder()
+	s.PutHandler(rec, httptest.NewRequest(http.MethodPost, "/put", io.MultiReader(bytes.NewReader([]byte("partial")), failingReader{})))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestBufferPieceHTTPSemantics(t *testing.T) {
+	s, err := NewBufferHTTPService(t.TempDir())
+	require.NoError(t, err)
+	data := []byte("0123456789abcdef")
+	resp := testPut(t, s, data)
+	etag := `"` + resp.CommP + `"`
+
+	serve := func(method string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, resp.URL, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		s.PieceHandler(rec, req)
+		return rec
+	}
+
+	rec := serve(http.MethodHead, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "16", rec.Header().Get("Content-Length"))
+	assert.Equal(t, etag, rec.Header().Get("ETag"))
+	assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+	assert.Empty(t, rec.Body.Bytes())
+
+	rec = serve(http.MethodGet, http.Header{"Range": {"bytes=10-"}})
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "abcdef", rec.Body.String())
+
+	// Resuming is only honoured while the data still matches
+	rec = serve(http.MethodGet, http.Header{"Range": {"bytes=10-"}, "If-Range": {etag}})
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	rec = serve(http.MethodGet, http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = serve(http.MethodPost, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math/bits"
+
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+)
+
+// aggregateCapacity incrementally tracks how much of a deal a set of pieces
+// occupies when laid out the way datasegment.NewAggregate places them in
+// aggregateOrder: the prefix car first, then pieces smallest first with each
+// piece aligned to its own size, and a 64 byte index entry per piece reserved
+// at the end of the deal.
+//
+// Pieces are counted per power of two size class so adding, removing and
+// checking a piece costs O(log dealSize) regardless of how many pieces the
+// aggregate holds. The full aggregate only needs to be built at seal time.
+type aggregateCapacity struct {
+	dealSize   uint64
+	maxEntries uint64
+	counts     [64]uint64 // number of pieces by log2 of their padded size
+	entries    uint64     // index entries used, including the prefix car
+	total      uint64     // sum of padded piece sizes, not including the prefix car
+}
+
+func newAggregateCapacity(dealSize uint64) *aggregateCapacity {
+	return &aggregateCapacity{
+		dealSize:   dealSize,
+		maxEntries: uint64(datasegment.MaxIndexEntriesInDeal(filabi.PaddedPieceSize(dealSize))),
+		entries:    1,
+	}
+}
+
+// Offset where the layout ends if a piece of size extra (0 for none) were added
+func (c *aggregateCapacity) end(extra uint64) uint64 {
+	offset := prefixCARSizePadded
+	for class := range c.counts {
+		n := c.counts[class]
+		size := uint64(1) << class
+		if size == extra {
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		// align to the piece size then place all pieces of this size back to back
+		offset = (offset+size-1)/size*size + n*size
+	}
+	return offset
+}
+
+// Fits reports whether a piece of the given padded size can be added
+func (c *aggregateCapacity) Fits(size uint64) bool {
+	if c.entries+1 > c.maxEntries {
+		return false
+	}
+	return c.end(size)+c.maxEntries*datasegment.EntrySize <= c.dealSize
+}
+
+// Valid reports whether the tracked pieces make a valid aggregate
+func (c *aggregateCapacity) Valid() bool {
+	if c.entries > c.maxEntries {
+		return false
+	}
+	return c.end(0)+c.maxEntries*datasegment.EntrySize <= c.dealSize
+}
+
+// Add a piece of the given padded size, callers check Fits first
+func (c *aggregateCapacity) Add(size uint64) {
+	c.counts[bits.TrailingZeros64(size)]++
+	c.entries++
+	c.total += size
+}
+
+// Remove a previously added piece of the given padded size
+func (c *aggregateCapacity) Remove(size uint64) {
+	c.counts[bits.TrailingZeros64(size)]--
+	c.entries--
+	c.total -= size
+}
+
+// Total padded size of the tracked pieces
+func (c *aggregateCapacity) Total() uint64 {
+	return c.total
+}
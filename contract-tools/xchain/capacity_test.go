@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+)
+
+// Build the full aggregate to decide whether offers fit, as runAggregate used to
+func fitsNewAggregate(dealSize uint64, events []DataReadyEvent) bool {
+	pieces := []filabi.PieceInfo{prefixPiece}
+	for _, event := range aggregateOrder(events) {
+		piece, err := event.Offer.Piece()
+		if err != nil {
+			return false
+		}
+		pieces = append(pieces, piece)
+	}
+	_, err := datasegment.NewAggregate(filabi.PaddedPieceSize(dealSize), pieces)
+	return err == nil
+}
+
+// The capacity tracker must agree with NewAggregate on every fit decision
+func TestAggregateCapacityMatchesNewAggregate(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	for _, dealSize := range []uint64{1 << 16, 1 << 20, 1 << 26} {
+		for trial := 0; trial < 50; trial++ {
+			c := newAggregateCapacity(dealSize)
+			var events []DataReadyEvent
+			for i := 0; i < 40; i++ {
+				event := testEvent(uint64(i+1), uint64(128)<<rng.Intn(14))
+				fits := fitsNewAggregate(dealSize, append(events, event))
+				if !assert.Equal(t, fits, c.Fits(event.Offer.Size), "deal %d pieces %d size %d", dealSize, len(events), event.Offer.Size) {
+					return
+				}
+				if fits {
+					events = append(events, event)
+					c.Add(event.Offer.Size)
+				}
+			}
+			assert.True(t, c.Valid())
+			assert.Equal(t, totalSize(events), c.Total())
+
+			// Removing pieces keeps the tracker in sync
+			for len(events) > 0 {
+				i := rng.Intn(len(events))
+				c.Remove(events[i].Offer.Size)
+				events = append(events[:i], events[i+1:]...)
+				assert.Equal(t, fitsNewAggregate(dealSize, events), c.Valid())
+			}
+		}
+	}
+}
+
+func benchmarkOffers(n int) []DataReadyEvent {
+	rng := rand.New(rand.NewSource(1))
+	events := make([]DataReadyEvent, n)
+	for i := range events {
+		events[i] = testEvent(uint64(i+1), uint64(1)<<(10+rng.Intn(6)))
+	}
+	return events
+}
+
+// Fit checking every offer of a 32GiB aggregate of small pieces by rebuilding the aggregate
+func BenchmarkFitCheckNewAggregate(b *testing.B) {
+	const dealSize = 32 << 30
+	events := benchmarkOffers(500)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := range events {
+			if !fitsNewAggregate(dealSize, events[:i+1]) {
+				b.Fatal("offers should fit")
+			}
+		}
+	}
+}
+
+// Fit checking the same offers with the incremental capacity tracker
+func BenchmarkFitCheckCapacity(b *testing.B) {
+	const dealSize = 32 << 30
+	events := benchmarkOffers(500)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		c := newAggregateCapacity(dealSize)
+		for _, event := range events {
+			if !c.Fits(event.Offer.Size) {
+				b.Fatal("offers should fit")
+			}
+			c.Add(event.Offer.Size)
+		}
+	}
+}
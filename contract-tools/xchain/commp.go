@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+)
+
+// commpWriter computes the piece CID of the data written to it with
+// commp.Calc. Close it when giving up before Sum to stop the calculation's
+// background workers.
+type commpWriter struct {
+	calc    commp.Calc
+	written uint64
+	done    bool
+}
+
+func (w *commpWriter) Write(p []byte) (int, error) {
+	n, err := w.calc.Write(p)
+	w.written += uint64(n)
+	return n, err
+}
+
+// Raw CommP and padded size of the data written so far
+func (w *commpWriter) digest() ([]byte, uint64, error) {
+	w.done = true
+	// CommP is undefined for tiny inputs, zero filling them up to the minimum
+	// stays within the first fr32 chunk and leaves the commitment unchanged
+	if w.written < commp.MinPiecePayload {
+		if _, err := w.calc.Write(make([]byte, commp.MinPiecePayload-w.written)); err != nil {
+			return nil, 0, err
+		}
+	}
+	return w.calc.Digest()
+}
+
+// Piece CID of the data written so far, zero padded to size
+func (w *commpWriter) Sum(size filabi.PaddedPieceSize) (cid.Cid, error) {
+	if err := size.Validate(); err != nil {
+		w.Close()
+		return cid.Undef, err
+	}
+	raw, padded, err := w.digest()
+	if err != nil {
+		return cid.Undef, err
+	}
+	if padded > uint64(size) {
+		return cid.Undef, fmt.Errorf("data does not fit in a piece of size %d", size)
+	}
+	raw, err = commp.PadCommP(raw, padded, uint64(size))
+	if err != nil {
+		return cid.Undef, err
+	}
+	return commcid.PieceCommitmentV1ToCID(raw)
+}
+
+// Stop the background workers of a calculation that was abandoned. Digesting
+// does this safely, unlike Calc.Reset which panics on inputs still buffered.
+func (w *commpWriter) Close() {
+	if !w.done && w.written > 0 {
+		w.digest()
+	}
+	w.done = true
+}
+
+// Smallest piece size holding unpadded bytes of data once fr32 padded
+func paddedPieceSize(unpadded uint64) filabi.PaddedPieceSize {
+	size := filabi.PaddedPieceSize(128)
+	for size.Unpadded() < filabi.UnpaddedPieceSize(unpadded) {
+		size <<= 1
+	}
+	return size
+}
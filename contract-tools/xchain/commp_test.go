@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"testing"
+
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Piece CID of data zero padded to size
+func testPieceCID(t *testing.T, data []byte, size filabi.PaddedPieceSize) cid.Cid {
+	var w commpWriter
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	pieceCID, err := w.Sum(size)
+	require.NoError(t, err)
+	return pieceCID
+}
+
+func TestCommpWriter(t *testing.T) {
+	prefixCARBytes, err := hex.DecodeString(prefixCAR)
+	require.NoError(t, err)
+	assert.Equal(t, prefixPiece.PieceCID, testPieceCID(t, prefixCARBytes, prefixPiece.Size))
+
+	// A whole aggregate hashes to the CommP built from its sub piece CommPs
+	transfer, _, expected := testTransfer(t)
+	r, err := newAggregateReader(transfer, nil)
+	require.NoError(t, err)
+	defer r.Close()
+	var w commpWriter
+	// Odd write sizes exercise chunk buffering
+	_, err = io.CopyBuffer(&w, r, make([]byte, 1000))
+	require.NoError(t, err)
+	commP, err := w.Sum(transfer.agg.DealSize)
+	require.NoError(t, err)
+	aggCommP, err := transfer.agg.PieceCID()
+	require.NoError(t, err)
+	assert.Equal(t, aggCommP, commP)
+	assert.Len(t, expected, int(transfer.agg.DealSize.Unpadded()))
+
+	// Inputs below the library's minimum payload hash like zero padded ones
+	assert.Equal(t, testPieceCID(t, append([]byte("tiny"), make([]byte, 123)...), 256), testPieceCID(t, []byte("tiny"), 256))
+
+	w = commpWriter{}
+	w.Write(make([]byte, 2000))
+	_, err = w.Sum(filabi.PaddedPieceSize(1024))
+	assert.Error(t, err)
+
+	// Abandoning a calculation with only buffered input stops it cleanly
+	w = commpWriter{}
+	w.Write([]byte("abandoned"))
+	w.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// confirmationQueue holds logs until they are buried under enough blocks to
+// be considered safe from chain reorganisations.
+type confirmationQueue struct {
+	depth uint64      // number of blocks that must be built on top of a log's block
+	logs  []types.Log // unconfirmed logs in arrival order
+}
+
+func newConfirmationQueue(depth uint64) *confirmationQueue {
+	return &confirmationQueue{depth: depth}
+}
+
+func sameLog(a, b types.Log) bool {
+	return a.TxHash == b.TxHash && a.Index == b.Index && a.BlockHash == b.BlockHash
+}
+
+// Add queues a log for confirmation, logs already queued are ignored
+func (q *confirmationQueue) Add(l types.Log) {
+	for _, queued := range q.logs {
+		if sameLog(queued, l) {
+			return
+		}
+	}
+	q.logs = append(q.logs, l)
+}
+
+// Remove drops the queued copy of a log that was removed by a reorg.
+// Returns false if the log is not queued, i.e. it was already released.
+func (q *confirmationQueue) Remove(l types.Log) bool {
+	for i, queued := range q.logs {
+		if sameLog(queued, l) {
+			q.logs = append(q.logs[:i], q.logs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Release removes and returns all logs that are confirmed at the given head,
+// preserving arrival order
+func (q *confirmationQueue) Release(head uint64) []types.Log {
+	var released []types.Log
+	kept := q.logs[:0]
+	for _, l := range q.logs {
+		if l.BlockNumber+q.depth <= head {
+			released = append(released, l)
+		} else {
+			kept = append(kept, l)
+		}
+	}
+	q.logs = kept
+	return released
+}
+
+// Requeue puts released logs back in front of the queue to be released again
+func (q *confirmationQueue) Requeue(logs []types.Log) {
+	q.logs = append(append([]types.Log(nil), logs...), q.logs...)
+}
+
+func (q *confirmationQueue) Len() int {
+	return len(q.logs)
+}
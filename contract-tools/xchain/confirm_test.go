@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func testLog(block uint64, index uint) types.Log {
+	return types.Log{
+		BlockNumber: block,
+		BlockHash:   common.BigToHash(new(big.Int).SetUint64(block)),
+		TxHash:      common.BigToHash(new(big.Int).SetUint64(block*1000 + uint64(index))),
+		Index:       index,
+	}
+}
+
+func TestConfirmationQueue(t *testing.T) {
+	q := newConfirmationQueue(5)
+	q.Add(testLog(10, 0))
+	q.Add(testLog(10, 1))
+	q.Add(testLog(12, 0))
+	q.Add(testLog(10, 0)) // duplicate from overlapping backfill
+	assert.Equal(t, 3, q.Len())
+
+	// Nothing is buried deep enough yet
+	assert.Empty(t, q.Release(14))
+
+	// A reorg removes an unconfirmed log before it is released
+	assert.True(t, q.Remove(testLog(10, 1)))
+	assert.False(t, q.Remove(testLog(10, 1)))
+
+	released := q.Release(15)
+	assert.Equal(t, []types.Log{testLog(10, 0)}, released)
+	assert.Equal(t, 1, q.Len())
+
+	released = q.Release(100)
+	assert.Equal(t, []types.Log{testLog(12, 0)}, released)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestConfirmationQueueZeroDepth(t *testing.T) {
+	q := newConfirmationQueue(0)
+	q.Add(testLog(7, 0))
+	assert.Equal(t, []types.Log{testLog(7, 0)}, q.Release(7))
+}
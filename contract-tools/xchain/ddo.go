@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	fbig "github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/builtin/v13/datacap"
+	"github.com/filecoin-project/go-state-types/builtin/v13/verifreg"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/lotus/api"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// Propose a storage market deal over the boost deal protocol
+	DealPathMarket = "market"
+	// Allocate DataCap to the provider for direct data onboarding
+	DealPathDDO = "ddo"
+
+	// Extra epochs past the minimum term a provider may keep earning power for an allocation
+	allocationTermSlack = 90 * builtin.EpochsInDay
+)
+
+// dealPath onboards a committed aggregate with one storage provider
+type dealPath interface {
+	propose(ctx context.Context, sp *storageProvider, aggCommp cid.Cid, transferID int) (DealRecord, error)
+}
+
+func (a *aggregator) dealPath(sp *storageProvider) dealPath {
+	if sp.terms.path == DealPathDDO {
+		return &ddoDealPath{a: a}
+	}
+	return &marketDealPath{a: a}
+}
+
+func newDealRecord(sp *storageProvider, aggCommp cid.Cid, transferID int) DealRecord {
+	return DealRecord{
+		UUID:       uuid.New(),
+		TransferID: transferID,
+		CommP:      aggCommp,
+		Provider:   sp.actor.String(),
+		Path:       sp.terms.path,
+		Proposed:   time.Now(),
+		// Only the provider the deal is made with may download the aggregate
+		TransferToken: newTransferToken(),
+	}
+}
+
+// marketDealPath makes a market deal with the provider's boost node
+type marketDealPath struct {
+	a *aggregator
+}
+
+func (p *marketDealPath) propose(ctx context.Context, sp *storageProvider, aggCommp cid.Cid, transferID int) (DealRecord, error) {
+	return p.a.sendDeal(ctx, sp, aggCommp, transferID)
+}
+
+// ddoDealPath transfers DataCap from the configured DDO client wallet to the
+// verified registry with an allocation request for the aggregate. The
+// provider claims the allocation when it onboards the aggregate, fetching
+// the data from the transfer endpoint out of band (e.g. boostd import-direct).
+// The deal is accepted once the message is pushed, the deal tracker reads the
+// allocation ID once it lands.
+type ddoDealPath struct {
+	a *aggregator
+}
+
+func (p *ddoDealPath) propose(ctx context.Context, sp *storageProvider, aggCommp cid.Cid, transferID int) (DealRecord, error) {
+	a := p.a
+	deal := newDealRecord(sp, aggCommp, transferID)
+	deal.Verified = true
+	if a.ddoClient == address.Undef {
+		return deal, fmt.Errorf("no DDO client wallet configured")
+	}
+
+	tipset, err := a.lotusAPI.ChainHead(ctx)
+	if err != nil {
+		return deal, fmt.Errorf("cannot get chain head: %w", err)
+	}
+	alloc, err := allocationRequest(sp, aggCommp, a.targetDealSize, tipset.Height())
+	if err != nil {
+		return deal, err
+	}
+	// The allocation must be claimed by its expiration, tracked like a market deal's start epoch
+	deal.StartEpoch = alloc.Expiration
+	deal.EndEpoch = alloc.Expiration + alloc.TermMax
+
+	params, err := allocationParams(alloc, a.targetDealSize)
+	if err != nil {
+		return deal, err
+	}
+	msg := &lotustypes.Message{
+		From:   a.ddoClient,
+		To:     builtin.DatacapActorAddr,
+		Method: builtin.MethodsDatacap.TransferExported,
+		Params: params,
+		Value:  fbig.Zero(),
+	}
+	smsg, err := a.lotusAPI.MpoolPushMessage(ctx, msg, nil)
+	if err != nil {
+		return deal, fmt.Errorf("failed to push allocation message: %w", err)
+	}
+	// Recorded with the deal so the DataCap is never transferred twice for it
+	msgCid := smsg.Cid()
+	deal.AllocationMsg = &msgCid
+	log.Printf("allocating %s to %s in message %s, UUID=%s", aggCommp, sp.actor, msgCid, deal.UUID)
+	return deal, nil
+}
+
+// Build the allocation request for an aggregate, keeping its terms within
+// the verified registry's bounds
+func allocationRequest(sp *storageProvider, aggCommp cid.Cid, dealSize uint64, height filabi.ChainEpoch) (verifreg.AllocationRequest, error) {
+	providerID, err := address.IDFromAddress(sp.actor)
+	if err != nil {
+		return verifreg.AllocationRequest{}, fmt.Errorf("DDO provider %s must be an ID address: %w", sp.actor, err)
+	}
+	termMin := sp.terms.duration
+	if termMin < verifreg.MinimumVerifiedAllocationTerm {
+		termMin = verifreg.MinimumVerifiedAllocationTerm
+	}
+	termMax := termMin + allocationTermSlack
+	if termMax > verifreg.MaximumVerifiedAllocationTerm {
+		termMax = verifreg.MaximumVerifiedAllocationTerm
+	}
+	if termMin > termMax {
+		return verifreg.AllocationRequest{}, fmt.Errorf("deal duration %d exceeds the maximum allocation term %d", termMin, termMax)
+	}
+	delay := sp.terms.startDelay
+	if delay > verifreg.MaximumVerifiedAllocationExpiration {
+		delay = verifreg.MaximumVerifiedAllocationExpiration
+	}
+	return verifreg.AllocationRequest{
+		Provider:   filabi.ActorID(providerID),
+		Data:       aggCommp,
+		Size:       filabi.PaddedPieceSize(dealSize),
+		TermMin:    termMin,
+		TermMax:    termMax,
+		Expiration: height + delay,
+	}, nil
+}
+
+// Params of a DataCap transfer to the verified registry creating the allocation
+func allocationParams(alloc verifreg.AllocationRequest, dealSize uint64) ([]byte, error) {
+	reqs := verifreg.AllocationRequests{Allocations: []verifreg.AllocationRequest{alloc}}
+	var operatorData bytes.Buffer
+	if err := reqs.MarshalCBOR(&operatorData); err != nil {
+		return nil, fmt.Errorf("failed to serialize allocation requests: %w", err)
+	}
+	transfer := datacap.TransferParams{
+		To:           builtin.VerifiedRegistryActorAddr,
+		Amount:       fbig.Mul(fbig.NewIntUnsigned(dealSize), builtin.TokenPrecision),
+		OperatorData: operatorData.Bytes(),
+	}
+	var params bytes.Buffer
+	if err := transfer.MarshalCBOR(&params); err != nil {
+		return nil, fmt.Errorf("failed to serialize datacap transfer: %w", err)
+	}
+	return params.Bytes(), nil
+}
+
+// Read the ID of the allocation created by a DataCap transfer
+func allocationID(lookup *api.MsgLookup) (verifreg.AllocationId, error) {
+	if lookup.Receipt.ExitCode != exitcode.Ok {
+		return 0, fmt.Errorf("allocation message failed with exit code %s", lookup.Receipt.ExitCode)
+	}
+	var ret datacap.TransferReturn
+	if err := ret.UnmarshalCBOR(bytes.NewReader(lookup.Receipt.Return)); err != nil {
+		return 0, fmt.Errorf("failed to decode datacap transfer return: %w", err)
+	}
+	var resp verifreg.AllocationsResponse
+	if err := resp.UnmarshalCBOR(bytes.NewReader(ret.RecipientData)); err != nil {
+		return 0, fmt.Errorf("failed to decode allocations response: %w", err)
+	}
+	if len(resp.NewAllocations) != 1 {
+		return 0, fmt.Errorf("expected one new allocation, got %d", len(resp.NewAllocations))
+	}
+	return resp.NewAllocations[0], nil
+}
+
+// Follow a DDO deal through the verified registry: active once the provider
+// claims the allocation, failed if it expires unclaimed
+func (a *aggregator) updateAllocation(ctx context.Context, deal *DealRecord, height filabi.ChainEpoch) bool {
+	provider, err := address.NewFromString(deal.Provider)
+	if err != nil {
+		log.Printf("invalid provider %s for deal %s: %s", deal.Provider, deal.UUID, err)
+		return false
+	}
+	if deal.AllocationID == 0 {
+		return a.resolveAllocation(ctx, deal, height)
+	}
+	claim, err := a.lotusAPI.StateGetClaim(ctx, provider, verifregtypes.ClaimId(deal.AllocationID), lotustypes.EmptyTSK)
+	if err != nil {
+		log.Printf("failed to get claim %d from %s: %s", deal.AllocationID, deal.Provider, err)
+		return false
+	}
+	changed := false
+	if claim != nil {
+		if end := claim.TermStart + claim.TermMax; end != deal.EndEpoch {
+			deal.EndEpoch = end
+			changed = true
+		}
+		if height > deal.EndEpoch {
+			return deal.transition(DealStateExpired, "") || changed
+		}
+		return deal.transition(DealStateActive, "") || changed
+	}
+	if height > deal.StartEpoch {
+		return deal.transition(DealStateFailed, fmt.Sprintf("allocation %d expired unclaimed at epoch %d", deal.AllocationID, deal.StartEpoch))
+	}
+	return false
+}
+
+// Read the allocation ID once the deal's DataCap transfer lands, failing the
+// deal if the transfer failed or missed the allocation expiration
+func (a *aggregator) resolveAllocation(ctx context.Context, deal *DealRecord, height filabi.ChainEpoch) bool {
+	if deal.AllocationMsg == nil {
+		return deal.transition(DealStateFailed, "no allocation message")
+	}
+	lookup, err := a.lotusAPI.StateSearchMsg(ctx, *deal.AllocationMsg)
+	if err != nil {
+		log.Printf("failed to search for allocation message %s: %s", deal.AllocationMsg, err)
+		return false
+	}
+	if lookup == nil {
+		if height > deal.StartEpoch {
+			return deal.transition(DealStateFailed, fmt.Sprintf("allocation message %s not on chain by epoch %d", deal.AllocationMsg, deal.StartEpoch))
+		}
+		return false
+	}
+	allocationID, err := allocationID(lookup)
+	if err != nil {
+		return deal.transition(DealStateFailed, err.Error())
+	}
+	deal.AllocationID = uint64(allocationID)
+	log.Printf("allocation %d for %s created, %s must import it from %s, see `xchain deals transfer-token %s`", allocationID, deal.CommP, deal.Provider, a.transferURL(deal.TransferID), deal.UUID)
+	return true
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	fbig "github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/builtin/v13/datacap"
+	"github.com/filecoin-project/go-state-types/builtin/v13/verifreg"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (m *fakeMarket) StateGetClaim(ctx context.Context, provider address.Address, id verifregtypes.ClaimId, tsk lotustypes.TipSetKey) (*verifregtypes.Claim, error) {
+	return m.claims[id], nil
+}
+
+func (m *fakeMarket) ChainHead(ctx context.Context) (*lotustypes.TipSet, error) {
+	miner, err := address.NewIDAddress(1000)
+	if err != nil {
+		return nil, err
+	}
+	c := cid.MustParse(prefixCARCid)
+	return lotustypes.NewTipSet([]*lotustypes.BlockHeader{{
+		Miner:                 miner,
+		Ticket:                &lotustypes.Ticket{VRFProof: []byte("ticket")},
+		ElectionProof:         &lotustypes.ElectionProof{VRFProof: []byte("proof")},
+		ParentWeight:          fbig.Zero(),
+		Height:                m.height,
+		ParentStateRoot:       c,
+		ParentMessageReceipts: c,
+		Messages:              c,
+		BLSAggregate:          &crypto.Signature{Type: crypto.SigTypeBLS},
+		BlockSig:              &crypto.Signature{Type: crypto.SigTypeBLS},
+		ParentBaseFee:         fbig.Zero(),
+	}})
+}
+
+func (m *fakeMarket) MpoolPushMessage(ctx context.Context, msg *lotustypes.Message, spec *api.MessageSendSpec) (*lotustypes.SignedMessage, error) {
+	m.pushed++
+	return &lotustypes.SignedMessage{Message: *msg, Signature: crypto.Signature{Type: crypto.SigTypeBLS}}, nil
+}
+
+// Every allocation message lands creating allocation 42
+func (m *fakeMarket) StateSearchMsg(ctx context.Context, msg cid.Cid) (*api.MsgLookup, error) {
+	if m.pending {
+		return nil, nil
+	}
+	var allocations bytes.Buffer
+	resp := verifreg.AllocationsResponse{NewAllocations: []verifreg.AllocationId{42}}
+	if err := resp.MarshalCBOR(&allocations); err != nil {
+		return nil, err
+	}
+	var ret bytes.Buffer
+	transfer := datacap.TransferReturn{FromBalance: fbig.Zero(), ToBalance: fbig.Zero(), RecipientData: allocations.Bytes()}
+	if err := transfer.MarshalCBOR(&ret); err != nil {
+		return nil, err
+	}
+	return &api.MsgLookup{Message: msg, Receipt: lotustypes.MessageReceipt{Return: ret.Bytes()}}, nil
+}
+
+func testDDOProvider(t *testing.T) *storageProvider {
+	actor, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	terms, err := (&Config{TargetAggSize: 1 << 30, DealTerms: DealTerms{Path: DealPathDDO}}).dealTerms(actor.String())
+	require.NoError(t, err)
+	return &storageProvider{actor: actor, terms: terms}
+}
+
+func TestAllocationRequest(t *testing.T) {
+	sp := testDDOProvider(t)
+	commP := cid.MustParse(prefixCARCid)
+
+	alloc, err := allocationRequest(sp, commP, 1<<30, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, filabi.ActorID(1000), alloc.Provider)
+	assert.Equal(t, filabi.PaddedPieceSize(1<<30), alloc.Size)
+	assert.Equal(t, filabi.ChainEpoch(defaultDealDuration), alloc.TermMin)
+	assert.Equal(t, alloc.TermMin+allocationTermSlack, alloc.TermMax)
+	assert.Equal(t, filabi.ChainEpoch(1000+defaultDealStartDelay), alloc.Expiration)
+
+	// Durations beyond the maximum allocation term cannot be allocated
+	long := *sp
+	long.terms.duration = verifreg.MaximumVerifiedAllocationTerm + 1
+	_, err = allocationRequest(&long, commP, 1<<30, 1000)
+	assert.Error(t, err)
+
+	params, err := allocationParams(alloc, 1<<30)
+	require.NoError(t, err)
+	var transfer datacap.TransferParams
+	require.NoError(t, transfer.UnmarshalCBOR(bytes.NewReader(params)))
+	assert.Equal(t, builtin.VerifiedRegistryActorAddr, transfer.To)
+	var reqs verifreg.AllocationRequests
+	require.NoError(t, reqs.UnmarshalCBOR(bytes.NewReader(transfer.OperatorData)))
+	assert.Equal(t, []verifreg.AllocationRequest{alloc}, reqs.Allocations)
+}
+
+func TestUpdateAllocation(t *testing.T) {
+	market := &fakeMarket{claims: map[verifregtypes.ClaimId]*verifregtypes.Claim{}}
+	a := &aggregator{lotusAPI: market}
+	deal := DealRecord{UUID: uuid.New(), Provider: "t01000", Path: DealPathDDO, AllocationID: 7, StartEpoch: 100, EndEpoch: 2000}
+	deal.transition(DealStateAccepted, "")
+
+	assert.False(t, a.updateAllocation(context.Background(), &deal, 50))
+	market.claims[7] = &verifregtypes.Claim{TermStart: 80, TermMax: 1000}
+	assert.True(t, a.updateAllocation(context.Background(), &deal, 90))
+	assert.Equal(t, DealStateActive, deal.State)
+	assert.Equal(t, filabi.ChainEpoch(1080), deal.EndEpoch)
+	assert.True(t, a.updateAllocation(context.Background(), &deal, 1081))
+	assert.Equal(t, DealStateExpired, deal.State)
+
+	unclaimed := DealRecord{UUID: uuid.New(), Provider: "t01000", Path: DealPathDDO, AllocationID: 8, StartEpoch: 100}
+	assert.True(t, a.updateAllocation(context.Background(), &unclaimed, 101))
+	assert.Equal(t, DealStateFailed, unclaimed.State)
+}
+
+func TestResolveAllocation(t *testing.T) {
+	market := &fakeMarket{claims: map[verifregtypes.ClaimId]*verifregtypes.Claim{}, pending: true}
+	a := &aggregator{lotusAPI: market}
+	msg := cid.MustParse(prefixCARCid)
+	deal := DealRecord{UUID: uuid.New(), Provider: "t01000", Path: DealPathDDO, AllocationMsg: &msg, StartEpoch: 100}
+	deal.transition(DealStateAccepted, "")
+
+	// The deal waits on the message without pushing another
+	assert.False(t, a.updateAllocation(context.Background(), &deal, 50))
+	assert.Equal(t, uint64(0), deal.AllocationID)
+	assert.Equal(t, DealStateAccepted, deal.State)
+	assert.Zero(t, market.pushed)
+
+	market.pending = false
+	assert.True(t, a.updateAllocation(context.Background(), &deal, 60))
+	assert.Equal(t, uint64(42), deal.AllocationID)
+	assert.Equal(t, DealStateAccepted, deal.State)
+
+	market.pending = true
+	lost := DealRecord{UUID: uuid.New(), Provider: "t01000", Path: DealPathDDO, AllocationMsg: &msg, StartEpoch: 100}
+	assert.True(t, a.updateAllocation(context.Background(), &lost, 101))
+	assert.Equal(t, DealStateFailed, lost.State)
+}
+
+func TestDDOTransferEndToEnd(t *testing.T) {
+	transfer, _, expected := testTransfer(t)
+	store, err := OpenStateStore(filepath.Join(t.TempDir(), "state.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	client, err := address.NewIDAddress(1001)
+	require.NoError(t, err)
+	market := &fakeMarket{height: 1000}
+	a := &aggregator{
+		store:          store,
+		lotusAPI:       market,
+		ddoClient:      client,
+		providers:      []*storageProvider{testDDOProvider(t)},
+		replication:    1,
+		targetDealSize: 1 << 20,
+		transfers:      map[int]AggregateTransfer{1: *transfer},
+		transferTokens: map[string]int{},
+		transferAddr:   "127.0.0.1:1728",
+		adminToken:     "admin-secret",
+	}
+	commP, err := transfer.agg.PieceCID()
+	require.NoError(t, err)
+	require.NoError(t, a.replicate(context.Background(), commP, 1))
+	deals, err := store.Deals(1)
+	require.NoError(t, err)
+	require.Len(t, deals, 1)
+	assert.NotNil(t, deals[0].AllocationMsg)
+
+	// The tracker reads the allocation once the message lands
+	require.NoError(t, a.pollDeals(context.Background()))
+	deals, err = store.Deals(1)
+	require.NoError(t, err)
+	require.Len(t, deals, 1)
+	assert.Equal(t, uint64(42), deals[0].AllocationID)
+
+	// A retry keeps the live deal instead of transferring the DataCap again
+	require.NoError(t, a.replicate(context.Background(), commP, 1))
+	assert.Equal(t, 1, market.pushed)
+
+	// The operator reads the token from the admin API and hands it to the provider
+	tokenRequest := func(auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/deals/transfer-token?deal="+deals[0].UUID.String(), nil)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		rec := httptest.NewRecorder()
+		a.adminHandler().ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(t, http.StatusUnauthorized, tokenRequest("").Code)
+	assert.Equal(t, http.StatusUnauthorized, tokenRequest("wrong").Code)
+	rec := tokenRequest("admin-secret")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp TransferTokenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "http://127.0.0.1:1728/?id=1", resp.URL)
+
+	// which downloads the whole aggregate with it
+	req := httptest.NewRequest(http.MethodGet, resp.URL, nil)
+	req.Header.Set("Authorization", "Bearer "+resp.Token)
+	rec = httptest.NewRecorder()
+	a.transferHandler(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, expected, rec.Body.Bytes())
+
+	// Once the allocation is claimed the token is no longer handed out
+	deals[0].transition(DealStateActive, "")
+	require.NoError(t, store.PutDeal(deals[0]))
+	assert.Equal(t, http.StatusConflict, tokenRequest("admin-secret").Code)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	boosttypes "github.com/filecoin-project/boost/storagemarket/types"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// libp2p identifier for the boost deal status protocol
+	DealStatusProtocolv120 = "/fil/storage/status/1.2.0"
+	// How often to check on proposed deals by default
+	defaultDealPollInterval = 5 * time.Minute
+)
+
+// Periodically follow every live deal through publish and activation,
+// re-proposing aggregates whose deals fail or are due for a retry
+func (a *aggregator) trackDeals(ctx context.Context) error {
+	ticker := time.NewTicker(a.dealPoll)
+	defer ticker.Stop()
+	retryTicker := time.NewTicker(retryCheckInterval)
+	defer retryTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := a.pollDeals(ctx); err != nil {
+				log.Printf("[ERROR] failed to poll deals: %s", err)
+			}
+		case <-retryTicker.C:
+			if err := a.retryDue(ctx); err != nil {
+				log.Printf("[ERROR] failed to retry deals: %s", err)
+			}
+		}
+	}
+}
+
+func (a *aggregator) pollDeals(ctx context.Context) error {
+	deals, err := a.store.AllDeals()
+	if err != nil {
+		return fmt.Errorf("failed to load deals: %w", err)
+	}
+	head, err := a.lotusAPI.ChainHead(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get chain head: %w", err)
+	}
+
+	failed := make(map[int]cid.Cid)
+	ended := make(map[int]bool)
+	for _, deal := range deals {
+		if !deal.live() {
+			continue
+		}
+		if !a.updateDeal(ctx, &deal, head.Height()) {
+			continue
+		}
+		log.Printf("Deal %s with %s for %s is %s %s", deal.UUID, deal.Provider, deal.CommP, deal.State, deal.Message)
+		if !deal.transferAllowed() {
+			a.revokeTransfer(deal.TransferToken)
+		}
+		if err := a.store.PutDeal(deal); err != nil {
+			return fmt.Errorf("failed to persist deal %s: %w", deal.UUID, err)
+		}
+		if deal.State == DealStateFailed {
+			failed[deal.TransferID] = deal.CommP
+		}
+		if deal.State == DealStateExpired {
+			ended[deal.TransferID] = true
+		}
+	}
+
+	for transferID := range ended {
+		if err := a.collectStaged(transferID); err != nil {
+			log.Printf("[ERROR] failed to collect staged data for transfer %d: %s", transferID, err)
+		}
+	}
+
+	for transferID, aggCommp := range failed {
+		if err := a.proposeAggregate(ctx, aggCommp, transferID); err != nil {
+			log.Printf("[ERROR] failed to re-propose aggregate %s: %s", aggCommp, err)
+		}
+	}
+	return nil
+}
+
+// Refresh a live deal from the provider and the market actor, reports whether
+// anything about the deal changed
+func (a *aggregator) updateDeal(ctx context.Context, deal *DealRecord, height filabi.ChainEpoch) bool {
+	if deal.Path == DealPathDDO {
+		return a.updateAllocation(ctx, deal, height)
+	}
+	changed := false
+	// Boost knows the chain deal ID once the deal is published
+	if deal.DealID == 0 {
+		status, err := a.dealStatus(ctx, deal)
+		if err != nil {
+			log.Printf("failed to get status of deal %s from %s: %s", deal.UUID, deal.Provider, err)
+		} else {
+			if status.Status != deal.Status {
+				deal.Status = status.Status
+				changed = true
+			}
+			if status.Error != "" {
+				return deal.transition(DealStateFailed, status.Error) || changed
+			}
+			if status.ChainDealID != 0 {
+				deal.DealID = status.ChainDealID
+				changed = true
+			}
+		}
+	}
+
+	if deal.DealID != 0 {
+		md, err := a.lotusAPI.StateMarketStorageDeal(ctx, deal.DealID, lotustypes.EmptyTSK)
+		if err != nil {
+			log.Printf("failed to get market deal %d: %s", deal.DealID, err)
+		} else {
+			changed = marketTransition(deal, md) || changed
+		}
+	}
+
+	switch {
+	case deal.State == DealStateActive && height > deal.EndEpoch:
+		changed = deal.transition(DealStateExpired, "") || changed
+	case deal.State != DealStateActive && deal.live() && height > deal.StartEpoch:
+		changed = deal.transition(DealStateFailed, fmt.Sprintf("missed start epoch %d", deal.StartEpoch)) || changed
+	}
+	return changed
+}
+
+// Move a deal into the state the market actor reports for it
+func marketTransition(deal *DealRecord, md *api.MarketDeal) bool {
+	switch {
+	case md.State.SlashEpoch > 0:
+		return deal.transition(DealStateFailed, fmt.Sprintf("slashed at epoch %d", md.State.SlashEpoch))
+	case md.State.SectorStartEpoch > 0:
+		return deal.transition(DealStateActive, "")
+	default:
+		return deal.transition(DealStatePublished, "")
+	}
+}
+
+// Ask the provider for the state of a deal over the boost status protocol
+func (a *aggregator) dealStatus(ctx context.Context, deal *DealRecord) (*boosttypes.DealStatus, error) {
+	sp, err := a.provider(deal.Provider)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.host.Connect(ctx, *sp.deal); err != nil {
+		return nil, fmt.Errorf("failed to connect to peer %s: %w", sp.deal.ID, err)
+	}
+	s, err := a.host.NewStream(ctx, sp.deal.ID, DealStatusProtocolv120)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	req := boosttypes.DealStatusRequest{
+		DealUUID:  deal.UUID,
+		Signature: contractSignature,
+	}
+	var resp boosttypes.DealStatusResponse
+	if err := doRpc(ctx, s, &req, &resp); err != nil {
+		return nil, fmt.Errorf("deal status rpc: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("deal status request failed: %s", resp.Error)
+	}
+	if resp.DealStatus == nil {
+		return nil, fmt.Errorf("no deal status in response")
+	}
+	return resp.DealStatus, nil
+}
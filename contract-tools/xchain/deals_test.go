@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/v0api"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMarket serves market actor deal state from memory
+type fakeMarket struct {
+	v0api.FullNode
+	deals   map[filabi.DealID]api.MarketDealState
+	dataCap *filabi.StoragePower
+	claims  map[verifregtypes.ClaimId]*verifregtypes.Claim
+	height  filabi.ChainEpoch
+	pushed  int  // messages pushed to the mpool
+	pending bool // pushed messages have not landed yet
+}
+
+func (m *fakeMarket) StateVerifiedClientStatus(ctx context.Context, addr address.Address, tsk lotustypes.TipSetKey) (*filabi.StoragePower, error) {
+	return m.dataCap, nil
+}
+
+func (m *fakeMarket) StateMarketStorageDeal(ctx context.Context, id filabi.DealID, tsk lotustypes.TipSetKey) (*api.MarketDeal, error) {
+	state, ok := m.deals[id]
+	if !ok {
+		return nil, assert.AnError
+	}
+	return &api.MarketDeal{State: state}, nil
+}
+
+func TestUpdateDealFollowsMarketState(t *testing.T) {
+	market := &fakeMarket{deals: map[filabi.DealID]api.MarketDealState{
+		1: {SectorStartEpoch: -1, SlashEpoch: -1},
+	}}
+	a := &aggregator{lotusAPI: market}
+	deal := DealRecord{UUID: uuid.New(), DealID: 1, StartEpoch: 100, EndEpoch: 1000}
+	deal.transition(DealStateAccepted, "")
+
+	assert.True(t, a.updateDeal(context.Background(), &deal, 10))
+	assert.Equal(t, DealStatePublished, deal.State)
+	assert.False(t, a.updateDeal(context.Background(), &deal, 20))
+
+	market.deals[1] = api.MarketDealState{SectorStartEpoch: 90, SlashEpoch: -1}
+	assert.True(t, a.updateDeal(context.Background(), &deal, 95))
+	assert.Equal(t, DealStateActive, deal.State)
+	// Active deals are not failed for passing their start epoch
+	assert.False(t, a.updateDeal(context.Background(), &deal, 200))
+
+	market.deals[1] = api.MarketDealState{SectorStartEpoch: 90, SlashEpoch: 300}
+	assert.True(t, a.updateDeal(context.Background(), &deal, 300))
+	assert.Equal(t, DealStateFailed, deal.State)
+	assert.False(t, deal.live())
+
+	var states []string
+	for _, tr := range deal.History {
+		states = append(states, tr.State)
+	}
+	assert.Equal(t, []string{DealStateAccepted, DealStatePublished, DealStateActive, DealStateFailed}, states)
+}
+
+func TestUpdateDealMissedStartEpoch(t *testing.T) {
+	a := &aggregator{lotusAPI: &fakeMarket{deals: map[filabi.DealID]api.MarketDealState{
+		1: {SectorStartEpoch: -1, SlashEpoch: -1},
+	}}}
+	deal := DealRecord{UUID: uuid.New(), DealID: 1, StartEpoch: 100, EndEpoch: 1000}
+	deal.transition(DealStatePublished, "")
+
+	assert.False(t, a.updateDeal(context.Background(), &deal, 100))
+	assert.True(t, a.updateDeal(context.Background(), &deal, 101))
+	assert.Equal(t, DealStateFailed, deal.State)
+	assert.Contains(t, deal.Message, "missed start epoch")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	fbig "github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/actors/policy"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+)
+
+const (
+	// Delay to start deal at. For 2k devnet 4 second block time this is 13.3 minutes
+	defaultDealStartDelay = 200
+	// Storage deal duration when offers do not request one
+	defaultDealDuration = 518400 // 6 months (on mainnet)
+	// Provider collateral as a percent of the market minimum, 20% extra as boost client does
+	defaultCollateralPercent = 120
+
+	// Always make unverified deals
+	VerifiedOff = "off"
+	// Make verified deals while the client has enough DataCap, unverified otherwise
+	VerifiedPrefer = "prefer"
+	// Only make verified deals, proposals fail without enough DataCap
+	VerifiedRequire = "require"
+)
+
+// DealTerms configure the deals aggregates are proposed with. Zero values
+// inherit from the global terms and then the defaults.
+type DealTerms struct {
+	StartDelay        int64  // epochs between proposal and deal start, defaults to 200
+	Duration          int64  // deal duration in epochs, defaults to 518400
+	PricePerEpoch     string // storage price per epoch in attoFIL, defaults to 0
+	CollateralPercent int64  // provider collateral as a percent of the market minimum, defaults to 120
+	Verified          string // FIL+ mode: off, prefer or require, defaults to off
+	Path              string // how aggregates are onboarded: market or ddo, defaults to market
+}
+
+// Validated deal terms for one provider
+type dealTerms struct {
+	startDelay        filabi.ChainEpoch
+	duration          filabi.ChainEpoch
+	price             fbig.Int
+	collateralPercent int64
+	verified          string
+	path              string
+}
+
+// Fill zero fields from base
+func (t DealTerms) inherit(base DealTerms) DealTerms {
+	if t.StartDelay == 0 {
+		t.StartDelay = base.StartDelay
+	}
+	if t.Duration == 0 {
+		t.Duration = base.Duration
+	}
+	if t.PricePerEpoch == "" {
+		t.PricePerEpoch = base.PricePerEpoch
+	}
+	if t.CollateralPercent == 0 {
+		t.CollateralPercent = base.CollateralPercent
+	}
+	if t.Verified == "" {
+		t.Verified = base.Verified
+	}
+	if t.Path == "" {
+		t.Path = base.Path
+	}
+	return t
+}
+
+// Resolve and validate the deal terms for a provider against the market
+// actor's deal duration bounds for the configured deal size
+func (cfg *Config) dealTerms(provider string) (dealTerms, error) {
+	raw := cfg.ProviderDealTerms[provider].inherit(cfg.DealTerms).inherit(DealTerms{
+		StartDelay:        defaultDealStartDelay,
+		Duration:          defaultDealDuration,
+		PricePerEpoch:     "0",
+		CollateralPercent: defaultCollateralPercent,
+		Verified:          VerifiedOff,
+		Path:              DealPathMarket,
+	})
+	if raw.StartDelay <= 0 {
+		return dealTerms{}, fmt.Errorf("deal start delay for %s must be positive, got %d", provider, raw.StartDelay)
+	}
+	minDuration, maxDuration := policy.DealDurationBounds(filabi.PaddedPieceSize(cfg.TargetAggSize))
+	duration := filabi.ChainEpoch(raw.Duration)
+	if duration < minDuration || duration > maxDuration {
+		return dealTerms{}, fmt.Errorf("deal duration for %s must be between %d and %d epochs, got %d", provider, minDuration, maxDuration, duration)
+	}
+	price, err := fbig.FromString(raw.PricePerEpoch)
+	if err != nil {
+		return dealTerms{}, fmt.Errorf("invalid deal price for %s: %w", provider, err)
+	}
+	if price.Sign() < 0 {
+		return dealTerms{}, fmt.Errorf("deal price for %s must not be negative, got %s", provider, price)
+	}
+	if raw.CollateralPercent < 100 {
+		return dealTerms{}, fmt.Errorf("provider collateral for %s must be at least 100%% of the market minimum, got %d%%", provider, raw.CollateralPercent)
+	}
+	switch raw.Verified {
+	case VerifiedOff, VerifiedPrefer, VerifiedRequire:
+	default:
+		return dealTerms{}, fmt.Errorf("unknown verified deal mode %q for %s", raw.Verified, provider)
+	}
+	if raw.Path != DealPathMarket && raw.Path != DealPathDDO {
+		return dealTerms{}, fmt.Errorf("unknown deal path %q for %s", raw.Path, provider)
+	}
+	return dealTerms{
+		startDelay:        filabi.ChainEpoch(raw.StartDelay),
+		duration:          duration,
+		price:             price,
+		collateralPercent: raw.CollateralPercent,
+		verified:          raw.Verified,
+		path:              raw.Path,
+	}, nil
+}
+
+// Provider collateral for a deal, checked against the market actor's bounds
+func (t dealTerms) collateral(min, max fbig.Int) (fbig.Int, error) {
+	collateral := fbig.Div(fbig.Mul(min, fbig.NewInt(t.collateralPercent)), fbig.NewInt(100))
+	if collateral.GreaterThan(max) {
+		return fbig.Zero(), fmt.Errorf("provider collateral %s exceeds the market maximum %s", collateral, max)
+	}
+	return collateral, nil
+}
+
+// Decide whether a deal with sp should be verified, based on the DataCap the
+// client holds. DataCap is only spent when a deal is published, so replicas
+// proposed at the same time may overcommit it; those fail to publish and are
+// re-proposed by the deal tracker.
+func (a *aggregator) verifiedDeal(ctx context.Context, sp *storageProvider, client address.Address) (bool, error) {
+	if sp.terms.verified == VerifiedOff {
+		return false, nil
+	}
+	dataCap, err := a.lotusAPI.StateVerifiedClientStatus(ctx, client, lotustypes.EmptyTSK)
+	if err != nil {
+		return false, fmt.Errorf("failed to get DataCap of %s: %w", client, err)
+	}
+	if dataCap != nil && dataCap.GreaterThanEqual(fbig.NewIntUnsigned(a.targetDealSize)) {
+		return true, nil
+	}
+	if sp.terms.verified == VerifiedRequire {
+		return false, fmt.Errorf("client %s has insufficient DataCap for a verified deal of %d bytes", client, a.targetDealSize)
+	}
+	log.Printf("client %s has insufficient DataCap, making an unverified deal with %s", client, sp.actor)
+	return false, nil
+}
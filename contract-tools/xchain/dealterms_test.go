@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	fbig "github.com/filecoin-project/go-state-types/big"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDealTermsInheritance(t *testing.T) {
+	cfg := &Config{
+		TargetAggSize: 1 << 30,
+		DealTerms:     DealTerms{Duration: 600000, PricePerEpoch: "10"},
+		ProviderDealTerms: map[string]DealTerms{
+			"t01001": {StartDelay: 2880, CollateralPercent: 150},
+		},
+	}
+	terms, err := cfg.dealTerms("t01000")
+	require.NoError(t, err)
+	assert.Equal(t, filabi.ChainEpoch(defaultDealStartDelay), terms.startDelay)
+	assert.Equal(t, filabi.ChainEpoch(600000), terms.duration)
+	assert.Equal(t, fbig.NewInt(10), terms.price)
+	assert.Equal(t, int64(defaultCollateralPercent), terms.collateralPercent)
+
+	terms, err = cfg.dealTerms("t01001")
+	require.NoError(t, err)
+	assert.Equal(t, filabi.ChainEpoch(2880), terms.startDelay)
+	assert.Equal(t, filabi.ChainEpoch(600000), terms.duration)
+	assert.Equal(t, int64(150), terms.collateralPercent)
+}
+
+func TestDealTermsValidation(t *testing.T) {
+	for name, terms := range map[string]DealTerms{
+		"short duration":   {Duration: 100},
+		"long duration":    {Duration: 1 << 40},
+		"negative delay":   {StartDelay: -1},
+		"negative price":   {PricePerEpoch: "-1"},
+		"bad price":        {PricePerEpoch: "lots"},
+		"under collateral": {CollateralPercent: 90},
+	} {
+		_, err := (&Config{TargetAggSize: 1 << 30, DealTerms: terms}).dealTerms("t01000")
+		assert.Error(t, err, name)
+	}
+}
+
+func TestDealTermsDurationAndCollateral(t *testing.T) {
+	terms, err := (&Config{TargetAggSize: 1 << 30}).dealTerms("t01000")
+	require.NoError(t, err)
+	assert.Equal(t, filabi.ChainEpoch(defaultDealDuration), terms.duration)
+
+	collateral, err := terms.collateral(fbig.NewInt(100), fbig.NewInt(1000))
+	require.NoError(t, err)
+	assert.Equal(t, fbig.NewInt(120), collateral)
+	_, err = terms.collateral(fbig.NewInt(100), fbig.NewInt(110))
+	assert.Error(t, err)
+}
+
+func TestVerifiedDealFallback(t *testing.T) {
+	market := &fakeMarket{}
+	a := &aggregator{lotusAPI: market, targetDealSize: 1 << 30}
+	client, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	sp := func(mode string) *storageProvider {
+		terms, err := (&Config{TargetAggSize: 1 << 30, DealTerms: DealTerms{Verified: mode}}).dealTerms("t01000")
+		require.NoError(t, err)
+		return &storageProvider{actor: client, terms: terms}
+	}
+
+	// Not a verified client
+	verified, err := a.verifiedDeal(context.Background(), sp(VerifiedPrefer), client)
+	require.NoError(t, err)
+	assert.False(t, verified)
+	_, err = a.verifiedDeal(context.Background(), sp(VerifiedRequire), client)
+	assert.Error(t, err)
+
+	// Not enough DataCap for the deal
+	dataCap := fbig.NewInt(1 << 20)
+	market.dataCap = &dataCap
+	verified, err = a.verifiedDeal(context.Background(), sp(VerifiedPrefer), client)
+	require.NoError(t, err)
+	assert.False(t, verified)
+
+	dataCap = fbig.NewInt(1 << 40)
+	verified, err = a.verifiedDeal(context.Background(), sp(VerifiedPrefer), client)
+	require.NoError(t, err)
+	assert.True(t, verified)
+	verified, err = a.verifiedDeal(context.Background(), sp(VerifiedOff), client)
+	require.NoError(t, err)
+	assert.False(t, verified)
+
+	_, err = (&Config{TargetAggSize: 1 << 30, DealTerms: DealTerms{Verified: "sometimes"}}).dealTerms("t01000")
+	assert.Error(t, err)
+}
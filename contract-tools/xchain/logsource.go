@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	// Subscribe to logs over a websocket or IPC connection
+	LogSourceSubscribe = "subscribe"
+	// Poll eth_getLogs over block ranges, works with plain HTTP endpoints
+	LogSourcePoll = "poll"
+	// Default interval between eth_getLogs polls
+	defaultLogPollInterval = 10 * time.Second
+	// Max block range per eth_getLogs request, Lotus caps this at 2880 by default
+	backfillBlockRange = 2000
+	// How often subscriptions check the chain head for newly confirmed logs
+	confirmationPollInterval = 10 * time.Second
+)
+
+// Subset of the eth client API needed to read logs
+type logClient interface {
+	ethereum.LogFilterer
+	BlockNumber(ctx context.Context) (uint64, error)
+}
+
+// logSink consumes the logs and chain head updates produced by a LogSource
+type logSink interface {
+	// Handle a new (or removed) log
+	handleLog(ctx context.Context, vLog types.Log) error
+	// Handle the chain reaching a new head, every log up to head must have
+	// been passed to handleLog since the block cursor may move past them
+	releaseConfirmed(ctx context.Context, head uint64) error
+	// First block to read logs from, ok is false if only new logs are wanted
+	startBlock() (block uint64, ok bool, err error)
+}
+
+// LogSource feeds logs matching a query to a sink until the context is done
+// or the source fails
+type LogSource interface {
+	Run(ctx context.Context, query ethereum.FilterQuery, sink logSink) error
+}
+
+// Pick a log source from config, when unset choose based on the API URL scheme:
+// websocket and IPC endpoints support subscriptions, HTTP endpoints do not
+func NewLogSource(cfg *Config, client logClient) (LogSource, error) {
+	kind := cfg.LogSource
+	if kind == "" {
+		u, err := url.Parse(cfg.Api)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse api url %s: %w", cfg.Api, err)
+		}
+		switch u.Scheme {
+		case "http", "https":
+			kind = LogSourcePoll
+		default:
+			kind = LogSourceSubscribe
+		}
+	}
+	switch kind {
+	case LogSourceSubscribe:
+		return &subscriptionSource{client: client}, nil
+	case LogSourcePoll:
+		interval := time.Duration(cfg.LogPollInterval) * time.Second
+		if interval == 0 {
+			interval = defaultLogPollInterval
+		}
+		return &pollingSource{
+			client:   client,
+			interval: interval,
+			depth:    cfg.ConfirmationDepth,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown log source %q, expected %q or %q", kind, LogSourceSubscribe, LogSourcePoll)
+	}
+}
+
+// Read logs in [from, to] in chunks small enough for RPC providers to serve
+func filterRange(ctx context.Context, client logClient, query ethereum.FilterQuery, from, to uint64, sink logSink) error {
+	for start := from; start <= to; start += backfillBlockRange {
+		end := start + backfillBlockRange - 1
+		if end > to {
+			end = to
+		}
+		q := query
+		q.FromBlock = new(big.Int).SetUint64(start)
+		q.ToBlock = new(big.Int).SetUint64(end)
+		logs, err := client.FilterLogs(ctx, q)
+		if err != nil {
+			return fmt.Errorf("failed to filter logs in blocks %d-%d: %w", start, end, err)
+		}
+		for _, vLog := range logs {
+			if err := sink.handleLog(ctx, vLog); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// subscriptionSource streams logs with eth_subscribe after catching up on
+// logs missed since the sink's start block
+type subscriptionSource struct {
+	client logClient
+}
+
+func (s *subscriptionSource) Run(ctx context.Context, query ethereum.FilterQuery, sink logSink) error {
+	logs := make(chan types.Log)
+	log.Printf("Subscribing to logs on %s\n", query.Addresses)
+	sub, err := s.client.SubscribeFilterLogs(ctx, query, logs)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	// Catch up on logs emitted while we were not subscribed. The subscription is
+	// opened first so nothing falls in the gap, overlapping logs are deduplicated.
+	from, ok, err := sink.startBlock()
+	if err != nil {
+		return err
+	}
+	head, err := s.client.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get chain head: %w", err)
+	}
+	if ok {
+		log.Printf("Backfilling logs from block %d to %d\n", from, head)
+		if err := filterRange(ctx, s.client, query, from, head, sink); err != nil {
+			return fmt.Errorf("failed to backfill logs: %w", err)
+		}
+		if err := sink.releaseConfirmed(ctx, head); err != nil {
+			return err
+		}
+	}
+	// Last block whose logs were all read
+	received := head
+
+	ticker := time.NewTicker(confirmationPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-sub.Err():
+			return err
+		case vLog := <-logs:
+			if err := sink.handleLog(ctx, vLog); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := s.catchUp(ctx, query, sink, &received); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Release logs confirmed at the chain head. A subscription cannot tell a
+// block without logs from one whose logs it has not delivered yet, so blocks
+// after *received are read with eth_getLogs first, overlapping logs are
+// deduplicated.
+func (s *subscriptionSource) catchUp(ctx context.Context, query ethereum.FilterQuery, sink logSink, received *uint64) error {
+	head, err := s.client.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get chain head: %w", err)
+	}
+	if head > *received {
+		if err := filterRange(ctx, s.client, query, *received+1, head, sink); err != nil {
+			return fmt.Errorf("failed to read logs up to head: %w", err)
+		}
+		*received = head
+	}
+	return sink.releaseConfirmed(ctx, head)
+}
+
+// pollingSource reads logs with eth_getLogs on an interval. It cannot observe
+// logs removed by reorgs so it never reads past the confirmation depth.
+type pollingSource struct {
+	client   logClient
+	interval time.Duration
+	depth    uint64
+}
+
+func (s *pollingSource) Run(ctx context.Context, query ethereum.FilterQuery, sink logSink) error {
+	next, ok, err := sink.startBlock()
+	if err != nil {
+		return err
+	}
+	if !ok { // only new logs wanted, start from the current head
+		head, err := s.client.BlockNumber(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get chain head: %w", err)
+		}
+		next = head + 1
+	}
+	log.Printf("Polling logs on %s every %s from block %d\n", query.Addresses, s.interval, next)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if err := s.poll(ctx, query, sink, &next); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Read confirmed logs from *next up to the chain head advancing *next as ranges
+// are consumed. RPC failures are logged and retried on the next poll, only sink
+// failures are returned.
+func (s *pollingSource) poll(ctx context.Context, query ethereum.FilterQuery, sink logSink, next *uint64) error {
+	head, err := s.client.BlockNumber(ctx)
+	if err != nil {
+		log.Printf("failed to get chain head, retrying: %s", err)
+		return nil
+	}
+	if head < s.depth {
+		return nil
+	}
+	confirmed := head - s.depth
+	for *next <= confirmed {
+		end := *next + backfillBlockRange - 1
+		if end > confirmed {
+			end = confirmed
+		}
+		q := query
+		q.FromBlock = new(big.Int).SetUint64(*next)
+		q.ToBlock = new(big.Int).SetUint64(end)
+		logs, err := s.client.FilterLogs(ctx, q)
+		if err != nil {
+			log.Printf("failed to filter logs in blocks %d-%d, retrying: %s", *next, end, err)
+			return nil
+		}
+		for _, vLog := range logs {
+			if err := sink.handleLog(ctx, vLog); err != nil {
+				return err
+			}
+		}
+		*next = end + 1
+	}
+	return sink.releaseConfirmed(ctx, head)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLogClient serves logs from memory and records requested ranges
+type fakeLogClient struct {
+	head   uint64
+	logs   []types.Log
+	ranges [][2]uint64
+}
+
+func (c *fakeLogClient) BlockNumber(ctx context.Context) (uint64, error) {
+	return c.head, nil
+}
+
+func (c *fakeLogClient) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	from, to := q.FromBlock.Uint64(), q.ToBlock.Uint64()
+	c.ranges = append(c.ranges, [2]uint64{from, to})
+	var out []types.Log
+	for _, l := range c.logs {
+		if l.BlockNumber >= from && l.BlockNumber <= to {
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
+
+func (c *fakeLogClient) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	panic("not supported")
+}
+
+type recordingSink struct {
+	start    uint64
+	hasStart bool
+	logs     []types.Log
+	heads    []uint64
+}
+
+func (s *recordingSink) handleLog(ctx context.Context, vLog types.Log) error {
+	s.logs = append(s.logs, vLog)
+	return nil
+}
+
+func (s *recordingSink) releaseConfirmed(ctx context.Context, head uint64) error {
+	s.heads = append(s.heads, head)
+	return nil
+}
+
+func (s *recordingSink) startBlock() (uint64, bool, error) {
+	return s.start, s.hasStart, nil
+}
+
+func TestPollingSourceReadsConfirmedRanges(t *testing.T) {
+	client := &fakeLogClient{
+		head: 4010,
+		logs: []types.Log{testLog(5, 0), testLog(2500, 0), testLog(4000, 0), testLog(4009, 0)},
+	}
+	src := &pollingSource{client: client, depth: 5}
+	sink := &recordingSink{start: 1, hasStart: true}
+
+	next := uint64(1)
+	require.NoError(t, src.poll(context.Background(), ethereum.FilterQuery{}, sink, &next))
+	// Blocks newer than head - depth are left for a later poll
+	assert.Equal(t, [][2]uint64{{1, 2000}, {2001, 4000}, {4001, 4005}}, client.ranges)
+	assert.Equal(t, []types.Log{testLog(5, 0), testLog(2500, 0), testLog(4000, 0)}, sink.logs)
+	assert.Equal(t, uint64(4006), next)
+
+	client.head = 4020
+	require.NoError(t, src.poll(context.Background(), ethereum.FilterQuery{}, sink, &next))
+	assert.Equal(t, [2]uint64{4006, 4015}, client.ranges[3])
+	assert.Equal(t, testLog(4009, 0), sink.logs[3])
+	assert.Equal(t, []uint64{4010, 4020}, sink.heads)
+}
+
+func TestSubscriptionReadsLogsBeforeRelease(t *testing.T) {
+	// The subscription has not delivered the log in block 105 yet
+	client := &fakeLogClient{head: 110, logs: []types.Log{testLog(105, 0)}}
+	src := &subscriptionSource{client: client}
+	sink := &recordingSink{}
+
+	received := uint64(100)
+	require.NoError(t, src.catchUp(context.Background(), ethereum.FilterQuery{}, sink, &received))
+	assert.Equal(t, [][2]uint64{{101, 110}}, client.ranges)
+	assert.Equal(t, []types.Log{testLog(105, 0)}, sink.logs)
+	assert.Equal(t, []uint64{110}, sink.heads)
+	assert.Equal(t, uint64(110), received)
+
+	// Nothing is read again while the head does not move
+	require.NoError(t, src.catchUp(context.Background(), ethereum.FilterQuery{}, sink, &received))
+	assert.Len(t, client.ranges, 1)
+	assert.Equal(t, []uint64{110, 110}, sink.heads)
+}
+
+func TestNewLogSourceFromScheme(t *testing.T) {
+	src, err := NewLogSource(&Config{Api: "http://localhost:1234/rpc/v1"}, &fakeLogClient{})
+	require.NoError(t, err)
+	assert.IsType(t, &pollingSource{}, src)
+
+	src, err = NewLogSource(&Config{Api: "ws://localhost:1234/rpc/v1"}, &fakeLogClient{})
+	require.NoError(t, err)
+	assert.IsType(t, &subscriptionSource{}, src)
+
+	src, err = NewLogSource(&Config{Api: "ws://localhost:1234/rpc/v1", LogSource: LogSourcePoll}, &fakeLogClient{})
+	require.NoError(t, err)
+	assert.IsType(t, &pollingSource{}, src)
+
+	_, err = NewLogSource(&Config{Api: "ws://localhost:1234/rpc/v1", LogSource: "carrier-pigeon"}, &fakeLogClient{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Where in the pipeline an offer was rejected
+const (
+	rejectedAdmission  = "admission"
+	rejectedValidation = "validation"
+	rejectedStaging    = "staging"
+	rejectedCommit     = "commit"
+)
+
+var (
+	offersReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "xchain_offers_received_total",
+		Help: "Confirmed DataReady events received",
+	})
+	offersRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "xchain_offers_rejected_total",
+		Help: "Offers not accepted for aggregation by the stage that rejected them",
+	}, []string{"stage"})
+	pendingOffers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "xchain_pending_offers",
+		Help: "Offers waiting to be aggregated",
+	})
+	pendingBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "xchain_pending_bytes",
+		Help: "Padded size of the offers waiting to be aggregated",
+	})
+	aggregatesCommitted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "xchain_aggregates_committed_total",
+		Help: "Aggregates committed on chain",
+	})
+	commitGasUsed = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "xchain_commit_aggregate_gas_used",
+		Help:    "Gas used by commitAggregate transactions",
+		Buckets: prometheus.ExponentialBuckets(1e6, 2, 12),
+	})
+	dealProposals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "xchain_deal_proposals_total",
+		Help: "Deal proposals by provider and whether the provider accepted them",
+	}, []string{"provider", "result"})
+	transferBytesServed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "xchain_transfer_bytes_served_total",
+		Help: "Aggregate bytes served to storage providers",
+	})
+	locationFetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "xchain_location_fetch_errors_total",
+		Help: "Failed fetches of offer data by location host",
+	}, []string{"host"})
+	bufferRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "xchain_buffer_requests_total",
+		Help: "Buffer service requests by operation and status code",
+	}, []string{"op", "code"})
+	bufferDiskBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "xchain_buffer_disk_bytes",
+		Help: "Bytes of data stored by the buffer service",
+	})
+)
+
+// Update the pending gauges, only called from the aggregation goroutine
+// which owns a.packing
+func (a *aggregator) observePending() {
+	pending := a.packing.Pending()
+	pendingOffers.Set(float64(len(pending)))
+	pendingBytes.Set(float64(totalSize(pending)))
+}
+
+// Count a failed fetch from an offer location, labelled by host to keep
+// cardinality bounded
+func fetchFailed(location string) {
+	host := "invalid"
+	if u, err := url.Parse(location); err == nil {
+		host = u.Host
+	}
+	locationFetchErrors.WithLabelValues(host).Inc()
+}
+
+// countingWriter counts the body bytes written to a response
+type countingWriter struct {
+	http.ResponseWriter
+	counter prometheus.Counter
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.counter.Add(float64(n))
+	return n, err
+}
+
+// statusRecorder remembers the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Count requests to a buffer handler by status code
+func countBufferRequests(op string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(rec, r)
+		bufferRequests.WithLabelValues(op, fmt.Sprint(rec.code)).Inc()
+	}
+}
+
+// Serve Prometheus metrics at /metrics until ctx is done
+func serveMetrics(ctx context.Context, port int) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{
+		Addr:    fmt.Sprintf("0.0.0.0:%d", port),
+		Handler: mux,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("Metrics HTTP server ListenAndServe: %v", err)
+		}
+	}()
+	<-ctx.Done()
+	return server.Shutdown(context.Background())
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferMetrics(t *testing.T) {
+	transfer, _, expected := testTransfer(t)
+	a := &aggregator{
+		transfers:      map[int]AggregateTransfer{1: *transfer},
+		transferTokens: map[string]int{"secret": 1},
+	}
+	served := testutil.ToFloat64(transferBytesServed)
+	req := httptest.NewRequest(http.MethodGet, "/?id=1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	a.transferHandler(httptest.NewRecorder(), req)
+	assert.Equal(t, served+float64(len(expected)), testutil.ToFloat64(transferBytesServed))
+
+	// Fetch errors are counted by location host
+	gone := httptest.NewServer(http.NotFoundHandler())
+	location := gone.URL + "/piece"
+	host := strings.TrimPrefix(gone.URL, "http://")
+	_, err := (&lazyHTTPReader{url: location}).Read(make([]byte, 1))
+	require.Error(t, err)
+	gone.Close()
+	_, err = (&lazyHTTPReader{url: location}).Read(make([]byte, 1))
+	require.Error(t, err)
+	assert.Equal(t, 2.0, testutil.ToFloat64(locationFetchErrors.WithLabelValues(host)))
+}
+
+func TestBufferRequestMetrics(t *testing.T) {
+	srv, err := NewBufferHTTPService(t.TempDir())
+	require.NoError(t, err)
+	put := countBufferRequests("put", srv.PutHandler)
+	get := countBufferRequests("get", srv.GetHandler)
+	puts := testutil.ToFloat64(bufferRequests.WithLabelValues("put", "200"))
+	misses := testutil.ToFloat64(bufferRequests.WithLabelValues("get", "404"))
+	disk := testutil.ToFloat64(bufferDiskBytes)
+
+	put(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/put", strings.NewReader("hello")))
+	get(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/get?id=9", nil))
+	assert.Equal(t, puts+1, testutil.ToFloat64(bufferRequests.WithLabelValues("put", "200")))
+	assert.Equal(t, misses+1, testutil.ToFloat64(bufferRequests.WithLabelValues("get", "404")))
+	assert.Equal(t, disk+5, testutil.ToFloat64(bufferDiskBytes))
+}
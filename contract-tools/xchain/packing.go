@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// Close the aggregate as soon as an offer does not fit
+	PackingGreedy = "greedy"
+	// Look ahead a window of offers past the first overflow and seal the largest ones that fit
+	PackingBestFit = "best-fit"
+	// Set aside large offers that do not fit and keep filling with smaller ones
+	PackingHoldLarge = "hold-large"
+
+	// Default number of offers the best fit strategy collects past the first overflow
+	defaultPackingWindow = 32
+	// By default offers bigger than 1/8th of the deal count as large
+	defaultHoldSizeDivisor = 8
+)
+
+// PackingStrategy decides which pending offers go into the next aggregate.
+// Offers passed to a strategy must each fit in an aggregate on their own.
+type PackingStrategy interface {
+	// Add an accepted offer. Returns the offers to seal into an aggregate when
+	// the strategy decides the current aggregate is complete, otherwise nil.
+	Add(event DataReadyEvent) []DataReadyEvent
+	// Close the current aggregate early, returning whatever offers it holds
+	// that make a valid aggregate. Offers that do not fit stay pending.
+	Flush() []DataReadyEvent
+	// Remove an offer retracted before commitment, reports whether it was held
+	Remove(offerID uint64) bool
+	// All offers held by the strategy
+	Pending() []DataReadyEvent
+}
+
+func NewPackingStrategy(cfg *Config) (PackingStrategy, error) {
+	dealSize := uint64(cfg.TargetAggSize)
+	switch cfg.PackingStrategy {
+	case "", PackingGreedy:
+		return &greedyPacking{pending: newOfferSet(dealSize)}, nil
+	case PackingBestFit:
+		window := cfg.PackingWindow
+		if window <= 0 {
+			window = defaultPackingWindow
+		}
+		return &bestFitPacking{dealSize: dealSize, window: window, pool: newOfferSet(dealSize)}, nil
+	case PackingHoldLarge:
+		holdSize := cfg.PackingHoldSize
+		if holdSize == 0 {
+			holdSize = dealSize / defaultHoldSizeDivisor
+		}
+		return &holdLargePacking{
+			holdSize: holdSize,
+			current:  newOfferSet(dealSize),
+			held:     newOfferSet(dealSize),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown packing strategy %q", cfg.PackingStrategy)
+	}
+}
+
+// Order offers as they are laid out in an aggregate. Pieces are placed
+// smallest first after the prefix car so small pieces fill the alignment
+// gaps that larger pieces would otherwise leave.
+func aggregateOrder(events []DataReadyEvent) []DataReadyEvent {
+	ordered := append([]DataReadyEvent{}, events...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Offer.Size < ordered[j].Offer.Size
+	})
+	return ordered
+}
+
+// Report whether offers make a valid aggregate of dealSize
+func fitsAggregate(dealSize uint64, events []DataReadyEvent) bool {
+	c := newAggregateCapacity(dealSize)
+	for _, event := range events {
+		if _, err := event.Offer.Piece(); err != nil {
+			return false
+		}
+		c.Add(event.Offer.Size)
+	}
+	return c.Valid()
+}
+
+func totalSize(events []DataReadyEvent) uint64 {
+	total := uint64(0)
+	for _, event := range events {
+		total += event.Offer.Size
+	}
+	return total
+}
+
+// offerSet is a list of offers together with their aggregate capacity
+type offerSet struct {
+	events   []DataReadyEvent
+	capacity *aggregateCapacity
+}
+
+func newOfferSet(dealSize uint64) *offerSet {
+	return &offerSet{capacity: newAggregateCapacity(dealSize)}
+}
+
+func (s *offerSet) fits(event DataReadyEvent) bool {
+	return s.capacity.Fits(event.Offer.Size)
+}
+
+// Add an offer regardless of whether it fits
+func (s *offerSet) add(event DataReadyEvent) {
+	s.events = append(s.events, event)
+	s.capacity.Add(event.Offer.Size)
+}
+
+func (s *offerSet) remove(offerID uint64) bool {
+	for i, event := range s.events {
+		if event.OfferID == offerID {
+			s.events = append(s.events[:i], s.events[i+1:]...)
+			s.capacity.Remove(event.Offer.Size)
+			return true
+		}
+	}
+	return false
+}
+
+// Empty the set returning the offers it held
+func (s *offerSet) take() []DataReadyEvent {
+	events := s.events
+	s.events = nil
+	s.capacity = newAggregateCapacity(s.capacity.dealSize)
+	return events
+}
+
+// greedyPacking adds offers in arrival order and seals as soon as one
+// overflows, the overflowing offer starts the next aggregate
+type greedyPacking struct {
+	pending *offerSet
+}
+
+func (p *greedyPacking) Add(event DataReadyEvent) []DataReadyEvent {
+	if p.pending.fits(event) {
+		p.pending.add(event)
+		return nil
+	}
+	sealed := p.pending.take()
+	p.pending.add(event)
+	return sealed
+}
+
+func (p *greedyPacking) Flush() []DataReadyEvent {
+	return p.pending.take()
+}
+
+func (p *greedyPacking) Remove(offerID uint64) bool {
+	return p.pending.remove(offerID)
+}
+
+func (p *greedyPacking) Pending() []DataReadyEvent {
+	return p.pending.events
+}
+
+// bestFitPacking keeps collecting offers for a window of arrivals after the
+// pool first overflows an aggregate, then seals the best fit decreasing
+// selection: the largest offers that fit, leaving the rest for the next aggregate
+type bestFitPacking struct {
+	dealSize   uint64
+	window     int
+	pool       *offerSet // capacity may exceed the deal once overflowed
+	overflowed int       // offers added since the pool stopped fitting in one aggregate
+}
+
+func (p *bestFitPacking) Add(event DataReadyEvent) []DataReadyEvent {
+	if p.overflowed == 0 && p.pool.fits(event) {
+		p.pool.add(event)
+		return nil
+	}
+	p.pool.add(event)
+	p.overflowed++
+	if p.overflowed < p.window {
+		return nil
+	}
+	return p.Flush()
+}
+
+func (p *bestFitPacking) Flush() []DataReadyEvent {
+	candidates := p.pool.take()
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Offer.Size > candidates[j].Offer.Size
+	})
+	sealed := newOfferSet(p.dealSize)
+	var rest []DataReadyEvent
+	for _, candidate := range candidates {
+		if sealed.fits(candidate) {
+			sealed.add(candidate)
+		} else {
+			rest = append(rest, candidate)
+		}
+	}
+	// Leftovers keep their arrival order
+	sort.SliceStable(rest, func(i, j int) bool {
+		return rest[i].OfferID < rest[j].OfferID
+	})
+	for _, event := range rest {
+		p.pool.add(event)
+	}
+	p.overflowed = 0
+	if !p.pool.capacity.Valid() {
+		// Leftovers still overflow, keep counting towards the next window
+		p.overflowed = 1
+	}
+	return sealed.events
+}
+
+func (p *bestFitPacking) Remove(offerID uint64) bool {
+	ok := p.pool.remove(offerID)
+	if ok && p.pool.capacity.Valid() {
+		p.overflowed = 0
+	}
+	return ok
+}
+
+func (p *bestFitPacking) Pending() []DataReadyEvent {
+	return p.pool.events
+}
+
+// holdLargePacking fills aggregates greedily but large offers that overflow
+// are held for the next aggregate instead of closing the current one. The
+// current aggregate is sealed when a small offer overflows it or the held
+// offers alone would fill an aggregate.
+type holdLargePacking struct {
+	holdSize uint64 // offers of at least this size are held when they overflow
+	current  *offerSet
+	held     *offerSet
+}
+
+func (p *holdLargePacking) Add(event DataReadyEvent) []DataReadyEvent {
+	if p.current.fits(event) {
+		p.current.add(event)
+		return nil
+	}
+	if event.Offer.Size >= p.holdSize && p.held.fits(event) {
+		p.held.add(event)
+		return nil
+	}
+
+	// Seal and start the next aggregate from held offers, then the overflowing offer
+	sealed := p.current.take()
+	p.refill(append(p.held.take(), event))
+	return sealed
+}
+
+func (p *holdLargePacking) Flush() []DataReadyEvent {
+	sealed := p.current.take()
+	p.refill(p.held.take())
+	return sealed
+}
+
+// Start a new current aggregate from queued offers, holding those that do not fit
+func (p *holdLargePacking) refill(queue []DataReadyEvent) {
+	for _, e := range queue {
+		if p.current.fits(e) {
+			p.current.add(e)
+		} else {
+			p.held.add(e)
+		}
+	}
+}
+
+func (p *holdLargePacking) Remove(offerID uint64) bool {
+	return p.current.remove(offerID) || p.held.remove(offerID)
+}
+
+func (p *holdLargePacking) Pending() []DataReadyEvent {
+	return append(append([]DataReadyEvent{}, p.current.events...), p.held.events...)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDealSize = uint64(1 << 30)
+
+// Many small offers followed by the occasional big one, the workload where
+// closing on the first overflow wastes the most space
+func testWorkload() []DataReadyEvent {
+	rng := rand.New(rand.NewSource(42))
+	var events []DataReadyEvent
+	for i := 0; i < 600; i++ {
+		size := uint64(1) << (10 + rng.Intn(12)) // 1KiB - 2MiB
+		if i%20 == 19 {
+			size = uint64(1) << (24 + rng.Intn(4)) // 16MiB - 128MiB
+		}
+		events = append(events, testEvent(uint64(i+1), size))
+	}
+	return events
+}
+
+// Run a strategy over the workload and return the mean fill ratio of the
+// sealed aggregates, checking every one against datasegment.NewAggregate
+func fillRatio(t *testing.T, strategy PackingStrategy, events []DataReadyEvent) float64 {
+	seen := make(map[uint64]bool)
+	var aggregates int
+	var filled float64
+	for _, event := range events {
+		sealed := strategy.Add(event)
+		if len(sealed) == 0 {
+			continue
+		}
+		pieces := []filabi.PieceInfo{prefixPiece}
+		for _, e := range aggregateOrder(sealed) {
+			assert.False(t, seen[e.OfferID], "offer %d sealed twice", e.OfferID)
+			seen[e.OfferID] = true
+			piece, err := e.Offer.Piece()
+			require.NoError(t, err)
+			pieces = append(pieces, piece)
+		}
+		_, err := datasegment.NewAggregate(filabi.PaddedPieceSize(testDealSize), pieces)
+		require.NoError(t, err)
+		aggregates++
+		filled += float64(totalSize(sealed)) / float64(testDealSize)
+	}
+	// Nothing is lost: every offer is either sealed or still pending
+	for _, e := range strategy.Pending() {
+		assert.False(t, seen[e.OfferID], "offer %d both sealed and pending", e.OfferID)
+		seen[e.OfferID] = true
+	}
+	assert.Len(t, seen, len(events))
+	require.NotZero(t, aggregates)
+	return filled / float64(aggregates)
+}
+
+func TestPackingStrategiesFillRatio(t *testing.T) {
+	events := testWorkload()
+	ratios := make(map[string]float64)
+	for _, name := range []string{PackingGreedy, PackingBestFit, PackingHoldLarge} {
+		strategy, err := NewPackingStrategy(&Config{
+			TargetAggSize:   int(testDealSize),
+			PackingStrategy: name,
+			PackingHoldSize: 16 << 20,
+		})
+		require.NoError(t, err)
+		ratios[name] = fillRatio(t, strategy, events)
+		t.Logf("%s mean fill ratio: %.3f", name, ratios[name])
+	}
+	assert.Greater(t, ratios[PackingBestFit], ratios[PackingGreedy])
+	assert.Greater(t, ratios[PackingHoldLarge], ratios[PackingGreedy])
+}
+
+func TestPackingStrategyRemove(t *testing.T) {
+	for _, name := range []string{PackingGreedy, PackingBestFit, PackingHoldLarge} {
+		strategy, err := NewPackingStrategy(&Config{TargetAggSize: int(testDealSize), PackingStrategy: name})
+		require.NoError(t, err)
+		assert.Nil(t, strategy.Add(testEvent(1, 1<<20)))
+		assert.Nil(t, strategy.Add(testEvent(2, 1<<20)))
+		assert.True(t, strategy.Remove(1), name)
+		assert.False(t, strategy.Remove(1), name)
+		assert.Equal(t, []DataReadyEvent{testEvent(2, 1<<20)}, strategy.Pending(), name)
+	}
+}
+
+func TestPackingStrategyFlush(t *testing.T) {
+	for _, name := range []string{PackingGreedy, PackingBestFit, PackingHoldLarge} {
+		strategy, err := NewPackingStrategy(&Config{TargetAggSize: int(testDealSize), PackingStrategy: name})
+		require.NoError(t, err)
+		assert.Nil(t, strategy.Add(testEvent(1, 1<<20)), name)
+		assert.Nil(t, strategy.Add(testEvent(2, 1<<10)), name)
+		sealed := strategy.Flush()
+		assert.ElementsMatch(t, []DataReadyEvent{testEvent(1, 1<<20), testEvent(2, 1<<10)}, sealed, name)
+		assert.Empty(t, strategy.Pending(), name)
+		assert.Empty(t, strategy.Flush(), name)
+	}
+}
+
+func TestUnknownPackingStrategy(t *testing.T) {
+	_, err := NewPackingStrategy(&Config{TargetAggSize: int(testDealSize), PackingStrategy: "tetris"})
+	assert.Error(t, err)
+}
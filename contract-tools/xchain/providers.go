@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api/v0api"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// A storage provider aggregates can be replicated to
+type storageProvider struct {
+	actor address.Address // address of the storage provider actor
+	deal  *peer.AddrInfo  // address to reach boost (or other) deal v 1.2 provider
+	terms dealTerms       // terms deals with this provider are proposed on
+}
+
+// Providers listed in config, falling back to the single ProviderAddr
+func (cfg *Config) providerAddrs() []string {
+	if len(cfg.Providers) > 0 {
+		return cfg.Providers
+	}
+	return []string{cfg.ProviderAddr}
+}
+
+// Look up a storage provider's deal making address from its on chain miner actor
+func resolveProvider(ctx context.Context, lAPI v0api.FullNode, addr string) (*storageProvider, error) {
+	providerAddr, err := address.NewFromString(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse provider address: %w", err)
+	}
+	minfo, err := lAPI.StateMinerInfo(ctx, providerAddr, lotustypes.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+	if minfo.PeerId == nil {
+		return nil, fmt.Errorf("sp %s has no peer id set on chain", providerAddr)
+	}
+	var maddrs []multiaddr.Multiaddr
+	for _, mma := range minfo.Multiaddrs {
+		ma, err := multiaddr.NewMultiaddrBytes(mma)
+		if err != nil {
+			return nil, fmt.Errorf("storage provider %s had invalid multiaddrs in their info: %w", providerAddr, err)
+		}
+		maddrs = append(maddrs, ma)
+	}
+	if len(maddrs) == 0 {
+		return nil, fmt.Errorf("storage provider %s has no multiaddrs set on-chain", providerAddr)
+	}
+	return &storageProvider{
+		actor: providerAddr,
+		deal: &peer.AddrInfo{
+			ID:    *minfo.PeerId,
+			Addrs: maddrs,
+		},
+	}, nil
+}
+
+// Propose an aggregate to providers in config order until a.replication of
+// them hold a live deal for it. A provider that rejects the proposal (or
+// cannot be reached) is substituted by the next provider without a live deal.
+// Providers whose earlier deal failed are proposed to again. Every proposal
+// outcome is recorded in the state store. Callers hold a.dealLk.
+func (a *aggregator) replicate(ctx context.Context, aggCommp cid.Cid, transferID int) error {
+	deals, err := a.store.Deals(transferID)
+	if err != nil {
+		return fmt.Errorf("failed to load deals for transfer %d: %w", transferID, err)
+	}
+	live := make(map[string]bool)
+	for _, deal := range deals {
+		if deal.live() {
+			live[deal.Provider] = true
+		}
+	}
+
+	replicas := len(live)
+	for _, sp := range a.providers {
+		if replicas >= a.replication {
+			break
+		}
+		if live[sp.actor.String()] {
+			continue
+		}
+		deal, err := a.dealPath(sp).propose(ctx, sp, aggCommp, transferID)
+		if err != nil {
+			log.Printf("[ERROR] failed to send deal for %s to %s: %s", aggCommp, sp.actor, err)
+			deal.transition(DealStateRejected, err.Error())
+			dealProposals.WithLabelValues(sp.actor.String(), "rejected").Inc()
+		} else {
+			replicas++
+			live[deal.Provider] = true
+			deal.transition(DealStateAccepted, "")
+			dealProposals.WithLabelValues(sp.actor.String(), "accepted").Inc()
+			a.allowTransfer(deal.TransferToken, transferID)
+			log.Printf("Deal %s for %s accepted by %s (%d/%d replicas)", deal.UUID, aggCommp, sp.actor, replicas, a.replication)
+		}
+		if err := a.store.PutDeal(deal); err != nil {
+			return fmt.Errorf("failed to persist deal %s: %w", deal.UUID, err)
+		}
+	}
+	if replicas < a.replication {
+		return fmt.Errorf("only %d of %d providers hold a deal for aggregate %s", replicas, a.replication, aggCommp)
+	}
+	return nil
+}
+
+// Find a configured provider by actor address
+func (a *aggregator) provider(addr string) (*storageProvider, error) {
+	for _, sp := range a.providers {
+		if sp.actor.String() == addr {
+			return sp, nil
+		}
+	}
+	return nil, fmt.Errorf("provider %s is not configured", addr)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// Default number of times an aggregate is proposed before giving up
+	defaultMaxDealAttempts = 10
+	// Delay before the first retry, doubled after every failed attempt
+	retryBaseDelay = time.Minute
+	// Longest delay between retries
+	retryMaxDelay = 6 * time.Hour
+	// How often to check for aggregates due for a retry
+	retryCheckInterval = 30 * time.Second
+)
+
+// Delay before the next attempt after the given number of failed attempts
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= retryMaxDelay {
+			return retryMaxDelay
+		}
+	}
+	return delay
+}
+
+// Replicate an aggregate, scheduling a retry with exponential backoff if too
+// few providers accept it
+func (a *aggregator) proposeAggregate(ctx context.Context, aggCommp cid.Cid, transferID int) error {
+	a.dealLk.Lock()
+	defer a.dealLk.Unlock()
+	return a.proposeLocked(ctx, aggCommp, transferID)
+}
+
+// Propose an aggregate holding a.dealLk, which also guards its retry record
+// so concurrent attempts are neither lost nor counted twice
+func (a *aggregator) proposeLocked(ctx context.Context, aggCommp cid.Cid, transferID int) error {
+	err := a.replicate(ctx, aggCommp, transferID)
+	if err == nil {
+		if err := a.store.DeleteRetry(transferID); err != nil {
+			return fmt.Errorf("failed to clear retries for transfer %d: %w", transferID, err)
+		}
+		return nil
+	}
+
+	rec, rerr := a.store.Retry(transferID)
+	if rerr != nil {
+		return fmt.Errorf("failed to load retries for transfer %d: %w", transferID, rerr)
+	}
+	if rec == nil {
+		rec = &RetryRecord{TransferID: transferID, CommP: aggCommp}
+	}
+	rec.Attempts++
+	rec.LastError = err.Error()
+	rec.NextAttempt = time.Now().Add(retryDelay(rec.Attempts))
+	if rec.Attempts >= a.maxAttempts {
+		log.Printf("[ERROR] giving up on aggregate %s after %d attempts, retry manually with `xchain deals retry %d`", aggCommp, rec.Attempts, transferID)
+	} else {
+		log.Printf("Retrying aggregate %s at %s (attempt %d of %d)", aggCommp, rec.NextAttempt.Format(time.RFC3339), rec.Attempts+1, a.maxAttempts)
+	}
+	if perr := a.store.PutRetry(*rec); perr != nil {
+		return fmt.Errorf("failed to persist retries for transfer %d: %w", transferID, perr)
+	}
+	return err
+}
+
+// Re-propose every aggregate whose next attempt is due
+func (a *aggregator) retryDue(ctx context.Context) error {
+	recs, err := a.store.Retries()
+	if err != nil {
+		return fmt.Errorf("failed to load retries: %w", err)
+	}
+	now := time.Now()
+	for _, rec := range recs {
+		if rec.Attempts >= a.maxAttempts || now.Before(rec.NextAttempt) {
+			continue
+		}
+		if err := a.proposeAggregate(ctx, rec.CommP, rec.TransferID); err != nil {
+			log.Printf("[ERROR] retry of aggregate %s failed: %s", rec.CommP, err)
+		}
+	}
+	return nil
+}
+
+// Find a committed aggregate by transfer ID or CommP
+func (a *aggregator) findAggregate(ref string) (*AggregateRecord, error) {
+	recs, err := a.store.Aggregates()
+	if err != nil {
+		return nil, err
+	}
+	transferID, idErr := strconv.Atoi(ref)
+	commP, cidErr := cid.Parse(ref)
+	if idErr != nil && cidErr != nil {
+		return nil, fmt.Errorf("%q is neither a transfer ID nor a CommP", ref)
+	}
+	for i := range recs {
+		if (idErr == nil && recs[i].TransferID == transferID) || (cidErr == nil && recs[i].CommP.Equals(commP)) {
+			return &recs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no committed aggregate %s", ref)
+}
+
+// Manually re-propose an aggregate, resetting its attempts so automatic
+// retries resume if this attempt fails too
+func (a *aggregator) retryAggregate(ctx context.Context, ref string) ([]DealRecord, error) {
+	rec, err := a.findAggregate(ref)
+	if err != nil {
+		return nil, err
+	}
+	a.dealLk.Lock()
+	if err := a.store.DeleteRetry(rec.TransferID); err != nil {
+		a.dealLk.Unlock()
+		return nil, fmt.Errorf("failed to reset retries for transfer %d: %w", rec.TransferID, err)
+	}
+	err = a.proposeLocked(ctx, rec.CommP, rec.TransferID)
+	a.dealLk.Unlock()
+	deals, derr := a.store.Deals(rec.TransferID)
+	if derr != nil {
+		return nil, derr
+	}
+	return deals, err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, time.Minute, retryDelay(1))
+	assert.Equal(t, 2*time.Minute, retryDelay(2))
+	assert.Equal(t, 8*time.Minute, retryDelay(4))
+	assert.Equal(t, retryMaxDelay, retryDelay(50))
+}
+
+// With no provider able to take the aggregate every attempt is recorded until
+// the attempt cap is reached
+func TestProposeAggregateRecordsAttempts(t *testing.T) {
+	store, err := OpenStateStore(filepath.Join(t.TempDir(), "state.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	a := &aggregator{store: store, replication: 1, maxAttempts: 2}
+	commP := cid.MustParse(prefixCARCid)
+	transferID, err := store.CommitAggregate(&AggregateRecord{CommP: commP, DealSize: 1 << 20})
+	require.NoError(t, err)
+
+	require.Error(t, a.proposeAggregate(context.Background(), commP, transferID))
+	rec, err := store.Retry(transferID)
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.Equal(t, 1, rec.Attempts)
+	assert.True(t, rec.NextAttempt.After(time.Now()))
+
+	// Not due yet
+	require.NoError(t, a.retryDue(context.Background()))
+	rec, err = store.Retry(transferID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rec.Attempts)
+
+	rec.NextAttempt = time.Now().Add(-time.Second)
+	require.NoError(t, store.PutRetry(*rec))
+	require.NoError(t, a.retryDue(context.Background()))
+	rec, err = store.Retry(transferID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, rec.Attempts)
+
+	// Capped, retryDue leaves it alone
+	rec.NextAttempt = time.Now().Add(-time.Second)
+	require.NoError(t, store.PutRetry(*rec))
+	require.NoError(t, a.retryDue(context.Background()))
+	rec, err = store.Retry(transferID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, rec.Attempts)
+
+	// A manual retry by CommP resets the count
+	_, err = a.retryAggregate(context.Background(), commP.String())
+	require.Error(t, err)
+	rec, err = store.Retry(transferID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rec.Attempts)
+
+	_, err = a.retryAggregate(context.Background(), "99")
+	assert.ErrorContains(t, err, "no committed aggregate")
+}
+
+func TestRetryRequiresAdminToken(t *testing.T) {
+	store, err := OpenStateStore(filepath.Join(t.TempDir(), "state.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	a := &aggregator{store: store, replication: 1}
+	retry := func(auth string) int {
+		req := httptest.NewRequest(http.MethodPost, "/deals/retry?aggregate=99", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		rec := httptest.NewRecorder()
+		a.adminHandler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusForbidden, retry("admin-secret"))
+
+	a.adminToken = "admin-secret"
+	assert.Equal(t, http.StatusUnauthorized, retry(""))
+	assert.Equal(t, http.StatusUnauthorized, retry("wrong"))
+	// Authorized, but there is no such aggregate
+	assert.Equal(t, http.StatusBadRequest, retry("admin-secret"))
+}
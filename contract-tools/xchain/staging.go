@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	defaultStagingPath = "~/.xchain/staging"
+	// Default time one download of an offer's data may take
+	defaultStagingTimeout = time.Hour
+	// Offers downloaded at once
+	stagingWorkers = 4
+	// Backoff between attempts to download an offer's data
+	stagingRetryMin = 30 * time.Second
+	stagingRetryMax = time.Hour
+)
+
+// errInvalidData marks offers whose data does not match the offer, which
+// downloading it again cannot fix
+var errInvalidData = errors.New("offer data is invalid")
+
+// stagingArea keeps a local copy of every accepted offer's data so aggregates
+// can still be transferred after a client's buffer location goes away.
+// Staged data is kept until all deals for its aggregate are active.
+type stagingArea struct {
+	dir      string
+	quota    uint64        // max bytes of staged data, 0 for no limit
+	timeout  time.Duration // max duration of one download
+	retryMin time.Duration // backoff after the first failed download
+	slots    chan struct{} // limits concurrent downloads
+
+	mu   sync.Mutex
+	used uint64 // bytes staged or reserved for downloads in progress
+}
+
+func newStagingArea(dir string, quota uint64) (*stagingArea, error) {
+	if dir == "" {
+		dir = defaultStagingPath
+	}
+	dir, err := homedir.Expand(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read staging directory: %w", err)
+	}
+	s := &stagingArea{
+		dir:      dir,
+		quota:    quota,
+		timeout:  defaultStagingTimeout,
+		retryMin: stagingRetryMin,
+		slots:    make(chan struct{}, stagingWorkers),
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			// Left over from a download interrupted by a crash
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.used += uint64(info.Size())
+	}
+	return s, nil
+}
+
+func (s *stagingArea) path(offerID uint64) string {
+	return filepath.Join(s.dir, "offer_"+strconv.FormatUint(offerID, 10))
+}
+
+// Reserve space for a download, failing if it would exceed the quota
+func (s *stagingArea) reserve(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quota != 0 && s.used+size > s.quota {
+		return fmt.Errorf("staging quota exceeded: %d of %d bytes used, need %d", s.used, s.quota, size)
+	}
+	s.used += size
+	return nil
+}
+
+func (s *stagingArea) release(size uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= size
+}
+
+// Download an offer's data from its location into the staging area,
+// failing if it does not match the offered piece
+func (s *stagingArea) Stage(ctx context.Context, event DataReadyEvent) error {
+	if s.Has(event.OfferID) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	piece, err := event.Offer.Piece()
+	if err != nil {
+		return err
+	}
+	maxSize := uint64(piece.Size.Unpadded())
+	if err := s.reserve(maxSize); err != nil {
+		return err
+	}
+	n, err := s.download(ctx, event.OfferID, event.Offer.Location, piece)
+	// Only keep what was actually written reserved
+	s.release(maxSize - n)
+	if err != nil {
+		s.release(n)
+		return err
+	}
+	return nil
+}
+
+func (s *stagingArea) download(ctx context.Context, offerID uint64, location string, piece filabi.PieceInfo) (uint64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fetchFailed(location)
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fetchFailed(location)
+		return 0, fmt.Errorf("failed to fetch %s: %s", location, resp.Status)
+	}
+
+	tmp := s.path(offerID) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	// Read one byte past the limit to detect data bigger than the offered piece
+	maxSize := int64(piece.Size.Unpadded())
+	commp := &commpWriter{}
+	defer commp.Close()
+	n, err := io.Copy(io.MultiWriter(f, commp), io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		fetchFailed(location)
+		return 0, fmt.Errorf("failed to download %s: %w", location, err)
+	}
+	if n > maxSize {
+		return 0, fmt.Errorf("%w: data at %s is bigger than the offered piece size", errInvalidData, location)
+	}
+	actual, err := commp.Sum(piece.Size)
+	if err != nil {
+		return 0, err
+	}
+	if !actual.Equals(piece.PieceCID) {
+		return 0, fmt.Errorf("%w: data at %s has CommP %s, offer claims %s", errInvalidData, location, actual, piece.PieceCID)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, s.path(offerID)); err != nil {
+		return 0, err
+	}
+	return uint64(n), nil
+}
+
+// Stage an offer, retrying failed downloads with backoff until the data is
+// staged, turns out not to match the offer or ctx is done. Locations that are
+// down for a while must not lose offers that were already paid for.
+func (s *stagingArea) StageRetrying(ctx context.Context, event DataReadyEvent) error {
+	backoff := s.retryMin
+	for {
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err := s.Stage(ctx, event)
+		<-s.slots
+		if err == nil || errors.Is(err, errInvalidData) || ctx.Err() != nil {
+			return err
+		}
+		log.Printf("failed to stage offer %d, retrying in %s: %s", event.OfferID, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, stagingRetryMax)
+	}
+}
+
+// stagingJob is an offer whose data a worker is staging
+type stagingJob struct {
+	event  DataReadyEvent
+	cancel context.CancelFunc
+	err    error // result of staging, set before the job is sent back
+}
+
+// Stage an offer in the background so a slow location holds up neither
+// other offers nor retractions, the job is sent back on a.staged when done
+func (a *aggregator) startStaging(ctx context.Context, event DataReadyEvent) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	job := &stagingJob{event: event, cancel: cancel}
+	a.inflight[event.OfferID] = job
+	a.stagingWG.Add(1)
+	go func() {
+		defer a.stagingWG.Done()
+		defer cancel()
+		job.err = a.staging.StageRetrying(jobCtx, event)
+		select {
+		case a.staged <- job:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// Accept an offer once its data is staged, or reject it if the data does not
+// match the offer
+func (a *aggregator) finishStaging(ctx context.Context, job *stagingJob) error {
+	id := job.event.OfferID
+	if a.inflight[id] != job {
+		// Retracted while staging, keep the data only if the offer came back
+		if _, ok := a.inflight[id]; !ok && job.err == nil {
+			if err := a.staging.Remove(id); err != nil {
+				log.Printf("failed to remove staged data of retracted offer %d: %s", id, err)
+			}
+		}
+		return nil
+	}
+	if job.err != nil && !errors.Is(job.err, errInvalidData) {
+		// Aggregation is stopping, the offer is replayed from the cursor on restart
+		return nil
+	}
+	delete(a.inflight, id)
+	if job.err != nil {
+		a.rejectOffer(job.event, rejectedStaging, fmt.Sprintf("failed to stage data: %s", job.err))
+	} else if err := a.addPending(ctx, job.event); err != nil {
+		return err
+	}
+	return a.advanceCursor()
+}
+
+func (s *stagingArea) Has(offerID uint64) bool {
+	_, err := os.Stat(s.path(offerID))
+	return err == nil
+}
+
+func (s *stagingArea) Open(offerID uint64) (*os.File, error) {
+	return os.Open(s.path(offerID))
+}
+
+// Delete an offer's staged data, if any
+func (s *stagingArea) Remove(offerID uint64) error {
+	info, err := os.Stat(s.path(offerID))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(offerID)); err != nil {
+		return err
+	}
+	s.release(uint64(info.Size()))
+	return nil
+}
+
+// Bytes of staged data
+func (s *stagingArea) Used() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// Source for a staged offer, falling back to the offer's location when it
+// was never staged (e.g. committed before staging was enabled)
+func (s *stagingArea) source(offerID uint64, location string) func(skip int64) io.ReadCloser {
+	return func(skip int64) io.ReadCloser {
+		f, err := s.Open(offerID)
+		if err != nil {
+			return &lazyHTTPReader{url: location, offset: skip}
+		}
+		if _, err := f.Seek(skip, io.SeekStart); err != nil {
+			f.Close()
+			return &lazyHTTPReader{url: location, offset: skip}
+		}
+		return f
+	}
+}
+
+// Garbage collect the staged data of an aggregate once the terms of its deals
+// have ended. Until then the tracker may re-propose it to replace a deal that
+// failed or was slashed, and the buffer may have dropped the offers' data.
+func (a *aggregator) collectStaged(transferID int) error {
+	deals, err := a.store.Deals(transferID)
+	if err != nil {
+		return err
+	}
+	expired := 0
+	for _, deal := range deals {
+		if deal.live() {
+			return nil
+		}
+		if deal.State == DealStateExpired {
+			expired++
+		}
+	}
+	if expired < a.replication {
+		return nil
+	}
+	a.transferLk.RLock()
+	offerIDs := a.transfers[transferID].offerIDs
+	a.transferLk.RUnlock()
+	for _, id := range offerIDs {
+		if err := a.staging.Remove(id); err != nil {
+			return fmt.Errorf("failed to remove staged offer %d: %w", id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testOfferEvent(t *testing.T, offerID uint64, location string, size uint64, data []byte) DataReadyEvent {
+	commP := testPieceCID(t, data, filabi.PaddedPieceSize(size))
+	return DataReadyEvent{
+		OfferID: offerID,
+		Offer: Offer{
+			CommP:    commP.Bytes(),
+			Size:     size,
+			Location: location,
+		},
+	}
+}
+
+func TestStagingArea(t *testing.T) {
+	transfer, buf, _ := testTransfer(t)
+	dir := t.TempDir()
+	// Left over from an interrupted download
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "offer_9.tmp"), []byte("partial"), 0644))
+
+	staged := uint64(len(buf.data["/piece0"]) + len(buf.data["/piece1"]))
+	// Room for the second offer's full unpadded size on top of the first
+	quota := uint64(len(buf.data["/piece0"])) + uint64(filabi.PaddedPieceSize(128<<10).Unpadded())
+	s, err := newStagingArea(dir, quota)
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(dir, "offer_9.tmp"))
+	assert.Zero(t, s.Used())
+
+	ctx := context.Background()
+	require.NoError(t, s.Stage(ctx, testOfferEvent(t, 1, transfer.locations[0], 32<<10, buf.data["/piece0"])))
+	assert.True(t, s.Has(1))
+	assert.Equal(t, uint64(len(buf.data["/piece0"])), s.Used())
+
+	// Data bigger than the offered piece is not staged
+	err = s.Stage(ctx, testOfferEvent(t, 2, transfer.locations[1], 32<<10, nil))
+	assert.Error(t, err)
+	assert.False(t, s.Has(2))
+	assert.Equal(t, uint64(len(buf.data["/piece0"])), s.Used())
+
+	// Data that does not hash to the offered CommP is not staged
+	err = s.Stage(ctx, testOfferEvent(t, 3, transfer.locations[0], 32<<10, buf.data["/piece0"][1:]))
+	assert.ErrorContains(t, err, "CommP")
+	assert.False(t, s.Has(3))
+	assert.Equal(t, uint64(len(buf.data["/piece0"])), s.Used())
+
+	// The offered size is reserved while downloading so this cannot fit
+	err = s.Stage(ctx, testOfferEvent(t, 2, transfer.locations[1], 256<<10, buf.data["/piece1"]))
+	assert.ErrorContains(t, err, "quota")
+
+	require.NoError(t, s.Stage(ctx, testOfferEvent(t, 2, transfer.locations[1], 128<<10, buf.data["/piece1"])))
+	assert.Equal(t, staged, s.Used())
+
+	// Usage is recovered on restart
+	s, err = newStagingArea(dir, quota)
+	require.NoError(t, err)
+	assert.Equal(t, staged, s.Used())
+
+	require.NoError(t, s.Remove(1))
+	require.NoError(t, s.Remove(1))
+	assert.False(t, s.Has(1))
+	assert.Equal(t, uint64(len(buf.data["/piece1"])), s.Used())
+}
+
+func TestTransferServedFromStaging(t *testing.T) {
+	transfer, buf, expected := testTransfer(t)
+	s, err := newStagingArea(t.TempDir(), 0)
+	require.NoError(t, err)
+	transfer.offerIDs = []uint64{1, 2}
+	ctx := context.Background()
+	require.NoError(t, s.Stage(ctx, testOfferEvent(t, 1, transfer.locations[0], 32<<10, buf.data["/piece0"])))
+	require.NoError(t, s.Stage(ctx, testOfferEvent(t, 2, transfer.locations[1], 128<<10, buf.data["/piece1"])))
+
+	// The buffer no longer has the data
+	buf.data = map[string][]byte{}
+	buf.requests = map[string]int{}
+
+	a := &aggregator{
+		transfers:      map[int]AggregateTransfer{1: *transfer},
+		transferTokens: map[string]int{"secret": 1},
+		staging:        s,
+	}
+	req := httptest.NewRequest(http.MethodGet, "/?id=1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	a.transferHandler(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, expected, rec.Body.Bytes())
+	assert.Empty(t, buf.requests)
+
+	// Unstaged offers are fetched from their location
+	require.NoError(t, s.Remove(2))
+	r, err := newAggregateReader(transfer, s)
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = r.Seek(int64(transfer.agg.Index.Entries[2].UnpaddedOffest()), io.SeekStart)
+	require.NoError(t, err)
+	_, err = r.Read(make([]byte, 10))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"/piece1": 1}, buf.requests)
+}
+
+func TestStagedKeptUntilDealsEnd(t *testing.T) {
+	transfer, buf, _ := testTransfer(t)
+	s, err := newStagingArea(t.TempDir(), 0)
+	require.NoError(t, err)
+	transfer.offerIDs = []uint64{1}
+	require.NoError(t, s.Stage(context.Background(), testOfferEvent(t, 1, transfer.locations[0], 32<<10, buf.data["/piece0"])))
+	store, err := OpenStateStore(filepath.Join(t.TempDir(), "state.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	a := &aggregator{
+		store:       store,
+		staging:     s,
+		replication: 1,
+		transfers:   map[int]AggregateTransfer{1: *transfer},
+	}
+	deal := DealRecord{UUID: uuid.New(), TransferID: 1, Provider: "t01000"}
+	deal.transition(DealStateActive, "")
+	require.NoError(t, store.PutDeal(deal))
+
+	// An active deal may still be slashed and re-proposed
+	require.NoError(t, a.collectStaged(1))
+	assert.NotZero(t, s.Used())
+
+	deal.transition(DealStateExpired, "")
+	require.NoError(t, store.PutDeal(deal))
+	require.NoError(t, a.collectStaged(1))
+	assert.Zero(t, s.Used())
+}
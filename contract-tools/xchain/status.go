@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// Providers may still download the aggregate
+	TransferStateServing = "serving"
+	// Enough deals are active, the aggregate is no longer served
+	TransferStateStored = "stored"
+	// Too few providers accepted the aggregate, it is waiting to be proposed again
+	TransferStateRetrying = "retrying"
+	// Proposals were given up on, see `xchain deals retry`
+	TransferStateFailed = "failed"
+	// No deal is in progress, e.g. right after commitment
+	TransferStateIdle = "idle"
+)
+
+// PendingStatus describes the offers waiting to be aggregated
+type PendingStatus struct {
+	Offers     []DataReadyEvent `json:"offers"`
+	Size       uint64           `json:"size"`
+	TargetSize uint64           `json:"targetSize"`
+	Fill       float64          `json:"fill"`
+}
+
+// AggregateStatus describes a committed aggregate and its deals
+type AggregateStatus struct {
+	TransferID   int          `json:"transferID"`
+	CommP        cid.Cid      `json:"commP"`
+	DealSize     uint64       `json:"dealSize"`
+	OfferIDs     []uint64     `json:"offerIDs"`
+	Committed    time.Time    `json:"committed"`
+	Transfer     string       `json:"transfer"`
+	ActiveDeals  int          `json:"activeDeals"`
+	Replication  int          `json:"replication"`
+	Deals        []DealRecord `json:"deals"`
+	Retry        *RetryRecord `json:"retry,omitempty"`
+	StagedOffers int          `json:"stagedOffers"`
+}
+
+// StatusResponse is everything `xchain status` shows
+type StatusResponse struct {
+	Pending    PendingStatus     `json:"pending"`
+	Aggregates []AggregateStatus `json:"aggregates"`
+	Rejected   []RejectedOffer   `json:"rejected"`
+}
+
+// Deal record without the secret its provider downloads the aggregate with
+func (d DealRecord) redacted() DealRecord {
+	d.TransferToken = ""
+	return d
+}
+
+func (a *aggregator) pendingStatus() (PendingStatus, error) {
+	// Read from the store rather than the packing strategy, which is owned
+	// by the aggregation goroutine
+	pending, err := a.store.Pending()
+	if err != nil {
+		return PendingStatus{}, err
+	}
+	size := totalSize(pending)
+	status := PendingStatus{Offers: pending, Size: size, TargetSize: a.targetDealSize}
+	if a.targetDealSize > 0 {
+		status.Fill = float64(size) / float64(a.targetDealSize)
+	}
+	return status, nil
+}
+
+func (a *aggregator) aggregateStatus(rec AggregateRecord) (AggregateStatus, error) {
+	status := AggregateStatus{
+		TransferID:  rec.TransferID,
+		CommP:       rec.CommP,
+		DealSize:    rec.DealSize,
+		OfferIDs:    rec.OfferIDs,
+		Committed:   rec.Committed,
+		Replication: a.replication,
+		Deals:       []DealRecord{},
+	}
+	deals, err := a.store.Deals(rec.TransferID)
+	if err != nil {
+		return status, err
+	}
+	serving := false
+	for _, deal := range deals {
+		status.Deals = append(status.Deals, deal.redacted())
+		if deal.State == DealStateActive {
+			status.ActiveDeals++
+		}
+		serving = serving || deal.transferAllowed()
+	}
+	status.Retry, err = a.store.Retry(rec.TransferID)
+	if err != nil {
+		return status, err
+	}
+	for _, id := range rec.OfferIDs {
+		if a.staging != nil && a.staging.Has(id) {
+			status.StagedOffers++
+		}
+	}
+	switch {
+	case serving:
+		status.Transfer = TransferStateServing
+	case status.ActiveDeals >= a.replication:
+		status.Transfer = TransferStateStored
+	case status.Retry != nil && status.Retry.Attempts >= a.maxAttempts:
+		status.Transfer = TransferStateFailed
+	case status.Retry != nil:
+		status.Transfer = TransferStateRetrying
+	default:
+		status.Transfer = TransferStateIdle
+	}
+	return status, nil
+}
+
+func (a *aggregator) aggregateStatuses() ([]AggregateStatus, error) {
+	recs, err := a.store.Aggregates()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]AggregateStatus, 0, len(recs))
+	for _, rec := range recs {
+		status, err := a.aggregateStatus(rec)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (a *aggregator) status() (StatusResponse, error) {
+	pending, err := a.pendingStatus()
+	if err != nil {
+		return StatusResponse{}, err
+	}
+	aggregates, err := a.aggregateStatuses()
+	if err != nil {
+		return StatusResponse{}, err
+	}
+	rejected, err := a.store.Rejected()
+	if err != nil {
+		return StatusResponse{}, err
+	}
+	return StatusResponse{Pending: pending, Aggregates: aggregates, Rejected: rejected}, nil
+}
+
+// Serve the result of a read-only query as JSON
+func getHandler(query func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := query(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, v)
+	}
+}
+
+func (a *aggregator) statusHandler(r *http.Request) (interface{}, error) {
+	return a.status()
+}
+
+func (a *aggregator) pendingHandler(r *http.Request) (interface{}, error) {
+	return a.pendingStatus()
+}
+
+func (a *aggregator) aggregatesHandler(r *http.Request) (interface{}, error) {
+	return a.aggregateStatuses()
+}
+
+// Status of one aggregate's transfer by transfer ID or CommP
+func (a *aggregator) transferStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rec, err := a.findAggregate(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	status, err := a.aggregateStatus(*rec)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// All deals, or those of the aggregate with the given transfer ID
+func (a *aggregator) dealsHandler(r *http.Request) (interface{}, error) {
+	var deals []DealRecord
+	var err error
+	if id := r.URL.Query().Get("aggregate"); id != "" {
+		transferID, perr := strconv.Atoi(id)
+		if perr != nil {
+			return nil, fmt.Errorf("invalid transfer ID %q", id)
+		}
+		deals, err = a.store.Deals(transferID)
+	} else {
+		deals, err = a.store.AllDeals()
+	}
+	if err != nil {
+		return nil, err
+	}
+	redacted := make([]DealRecord, 0, len(deals))
+	for _, deal := range deals {
+		redacted = append(redacted, deal.redacted())
+	}
+	return redacted, nil
+}
+
+func (a *aggregator) rejectedHandler(r *http.Request) (interface{}, error) {
+	return a.store.Rejected()
+}
+
+// Print a daemon's status for `xchain status`
+func printStatus(out io.Writer, status StatusResponse) {
+	p := status.Pending
+	fmt.Fprintf(out, "Pending: %d offers, %d of %d bytes (%.1f%% full)\n", len(p.Offers), p.Size, p.TargetSize, 100*p.Fill)
+	for _, event := range p.Offers {
+		fmt.Fprintf(out, "  offer %d\tsize %d\treceived %s\n", event.OfferID, event.Offer.Size, event.Received.Format(time.RFC3339))
+	}
+
+	fmt.Fprintf(out, "\nAggregates: %d\n", len(status.Aggregates))
+	tw := tabwriter.NewWriter(out, 2, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCOMMP\tOFFERS\tTRANSFER\tACTIVE\tCOMMITTED")
+	for _, agg := range status.Aggregates {
+		fmt.Fprintf(tw, "%d\t%s\t%v\t%s\t%d/%d\t%s\n", agg.TransferID, agg.CommP, agg.OfferIDs, agg.Transfer, agg.ActiveDeals, agg.Replication, agg.Committed.Format(time.RFC3339))
+	}
+	tw.Flush()
+
+	var deals int
+	for _, agg := range status.Aggregates {
+		deals += len(agg.Deals)
+	}
+	fmt.Fprintf(out, "\nDeals: %d\n", deals)
+	tw = tabwriter.NewWriter(out, 2, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "AGGREGATE\tUUID\tPROVIDER\tPATH\tSTATE\tMESSAGE")
+	for _, agg := range status.Aggregates {
+		for _, deal := range agg.Deals {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", agg.TransferID, deal.UUID, deal.Provider, deal.Path, deal.State, deal.Message)
+		}
+	}
+	tw.Flush()
+
+	fmt.Fprintf(out, "\nRejected offers: %d\n", len(status.Rejected))
+	for _, rec := range status.Rejected {
+		fmt.Fprintf(out, "  offer %d\t%s\t%s\n", rec.OfferID, rec.Rejected.Format(time.RFC3339), rec.Reason)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminStatus(t *testing.T) {
+	store, err := OpenStateStore(filepath.Join(t.TempDir(), "state.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	a := &aggregator{store: store, replication: 2, maxAttempts: 3, targetDealSize: 1 << 20}
+
+	require.NoError(t, store.PutPending(DataReadyEvent{OfferID: 1, Offer: Offer{Size: 1 << 18}}))
+	require.NoError(t, store.PutPending(DataReadyEvent{OfferID: 2, Offer: Offer{Size: 1 << 17}}))
+	commP := cid.MustParse(prefixCARCid)
+	transferID, err := store.CommitAggregate(&AggregateRecord{CommP: commP, DealSize: 1 << 20, OfferIDs: []uint64{3}})
+	require.NoError(t, err)
+	active := DealRecord{UUID: uuid.New(), TransferID: transferID, CommP: commP, Provider: "t01000", TransferToken: "secret"}
+	active.transition(DealStateActive, "")
+	accepted := DealRecord{UUID: uuid.New(), TransferID: transferID, CommP: commP, Provider: "t01001", TransferToken: "secret"}
+	accepted.transition(DealStateAccepted, "")
+	require.NoError(t, store.PutDeal(active))
+	require.NoError(t, store.PutDeal(accepted))
+	require.NoError(t, store.PutRejected(RejectedOffer{OfferID: 4, Reason: "token is not accepted"}))
+
+	get := func(path string, v interface{}) {
+		rec := httptest.NewRecorder()
+		a.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.NotContains(t, rec.Body.String(), "secret")
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+
+	var status StatusResponse
+	get("/status", &status)
+	assert.Len(t, status.Pending.Offers, 2)
+	assert.Equal(t, uint64(3<<17), status.Pending.Size)
+	assert.InDelta(t, 0.375, status.Pending.Fill, 1e-9)
+	require.Len(t, status.Aggregates, 1)
+	agg := status.Aggregates[0]
+	assert.Equal(t, commP, agg.CommP)
+	assert.Equal(t, []uint64{3}, agg.OfferIDs)
+	assert.Equal(t, TransferStateServing, agg.Transfer)
+	assert.Equal(t, 1, agg.ActiveDeals)
+	assert.Len(t, agg.Deals, 2)
+	require.Len(t, status.Rejected, 1)
+	assert.Equal(t, "token is not accepted", status.Rejected[0].Reason)
+
+	// Once the second provider activates the aggregate is stored
+	accepted.transition(DealStateActive, "")
+	require.NoError(t, store.PutDeal(accepted))
+	var transfer AggregateStatus
+	get("/transfer?id="+commP.String(), &transfer)
+	assert.Equal(t, TransferStateStored, transfer.Transfer)
+
+	var deals []DealRecord
+	get("/deals?aggregate=1", &deals)
+	assert.Len(t, deals, 2)
+
+	rec := httptest.NewRecorder()
+	a.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/transfer?id=9", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = httptest.NewRecorder()
+	a.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/status", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/mitchellh/go-homedir"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Default location of the aggregator state database
+const defaultStatePath = "~/.xchain/state.db"
+
+var (
+	pendingBucket   = []byte("pending")
+	aggregateBucket = []byte("aggregates")
+	metaBucket      = []byte("meta")
+	dealBucket      = []byte("deals")
+	retryBucket     = []byte("retries")
+	rejectedBucket  = []byte("rejected")
+
+	cursorKey = []byte("cursor")
+)
+
+// StateStore persists the aggregator state that must survive a daemon restart:
+// offers waiting to be aggregated and committed aggregates waiting to be
+// transferred to storage providers.
+type StateStore interface {
+	// Add an offer to the pending set
+	PutPending(event DataReadyEvent) error
+	// Remove an offer from the pending set
+	DeletePending(offerID uint64) error
+	// All pending offers ordered by offer ID
+	Pending() ([]DataReadyEvent, error)
+	// Record a committed aggregate under a newly allocated transfer ID and remove
+	// its offers from the pending set in a single transaction
+	CommitAggregate(rec *AggregateRecord) (int, error)
+	// All committed aggregates ordered by transfer ID
+	Aggregates() ([]AggregateRecord, error)
+	// Add or update a deal proposal
+	PutDeal(deal DealRecord) error
+	// All deals proposed for the aggregate with the given transfer ID
+	Deals(transferID int) ([]DealRecord, error)
+	// All deals proposed for any aggregate
+	AllDeals() ([]DealRecord, error)
+	// Add or update the retry state of an aggregate
+	PutRetry(rec RetryRecord) error
+	// Retry state of the aggregate with the given transfer ID, nil if none
+	Retry(transferID int) (*RetryRecord, error)
+	// Forget the retry state of an aggregate once it is fully replicated
+	DeleteRetry(transferID int) error
+	// All aggregates waiting to be re-proposed ordered by transfer ID
+	Retries() ([]RetryRecord, error)
+	// Record why an offer was not accepted for aggregation
+	PutRejected(rec RejectedOffer) error
+	// All rejected offers ordered by offer ID
+	Rejected() ([]RejectedOffer, error)
+	// Record the last block whose DataReady events have been fully processed
+	SetCursor(block uint64) error
+	// Last processed block, ok is false if no block has been processed yet
+	Cursor() (block uint64, ok bool, err error)
+	Close() error
+}
+
+// AggregateRecord is the durable description of a committed aggregate.
+// It carries everything needed to rebuild the aggregate layout and serve
+// the aggregate's data at `/?id={TransferID}`.
+type AggregateRecord struct {
+	TransferID int                `json:"transferID"`
+	CommP      cid.Cid            `json:"commP"`
+	DealSize   uint64             `json:"dealSize"`
+	Pieces     []filabi.PieceInfo `json:"pieces"` // sub pieces in aggregate order, not including the prefix car
+	OfferIDs   []uint64           `json:"offerIDs"`
+	Locations  []string           `json:"locations"`
+	Committed  time.Time          `json:"committed"`
+}
+
+const (
+	// The provider accepted the deal proposal
+	DealStateAccepted = "accepted"
+	// The provider rejected the deal proposal or could not be reached
+	DealStateRejected = "rejected"
+	// The deal was published to the market actor
+	DealStatePublished = "published"
+	// The deal's sector was proven on chain
+	DealStateActive = "active"
+	// The deal failed at the provider, was slashed or missed its start epoch
+	DealStateFailed = "failed"
+	// The deal reached its end epoch
+	DealStateExpired = "expired"
+)
+
+// DealRecord tracks a deal proposal for a committed aggregate to one provider
+type DealRecord struct {
+	UUID          uuid.UUID             `json:"uuid"`
+	TransferID    int                   `json:"transferID"`
+	CommP         cid.Cid               `json:"commP"`
+	Provider      string                `json:"provider"`
+	State         string                `json:"state"`
+	Message       string                `json:"message,omitempty"` // why the deal was rejected or failed
+	Status        string                `json:"status,omitempty"`  // last checkpoint reported by boost
+	DealID        filabi.DealID         `json:"dealID,omitempty"`  // market actor deal ID once published
+	StartEpoch    filabi.ChainEpoch     `json:"startEpoch"`
+	EndEpoch      filabi.ChainEpoch     `json:"endEpoch"`
+	Verified      bool                  `json:"verified"`
+	Path          string                `json:"path"`                    // market or ddo
+	AllocationID  uint64                `json:"allocationID,omitempty"`  // verified registry allocation of a DDO deal
+	AllocationMsg *cid.Cid              `json:"allocationMsg,omitempty"` // DataCap transfer creating the allocation
+	TransferToken string                `json:"transferToken"`           // bearer token the provider downloads the aggregate with
+	Proposed      time.Time             `json:"proposed"`
+	History       []DealStateTransition `json:"history"`
+}
+
+// DealStateTransition records a deal moving into a new state
+type DealStateTransition struct {
+	State   string    `json:"state"`
+	Message string    `json:"message,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// Move the deal into a new state, reports whether the state changed
+func (d *DealRecord) transition(state, message string) bool {
+	if d.State == state {
+		return false
+	}
+	d.State = state
+	d.Message = message
+	d.History = append(d.History, DealStateTransition{State: state, Message: message, At: time.Now()})
+	return true
+}
+
+// Reports whether the provider may still download the aggregate, which
+// stops once the deal is active or has failed
+func (d *DealRecord) transferAllowed() bool {
+	return d.TransferToken != "" && (d.State == DealStateAccepted || d.State == DealStatePublished)
+}
+
+// Reports whether the deal still counts as a replica of its aggregate
+func (d *DealRecord) live() bool {
+	switch d.State {
+	case DealStateAccepted, DealStatePublished, DealStateActive:
+		return true
+	}
+	return false
+}
+
+// RetryRecord tracks failed attempts to get an aggregate replicated
+type RetryRecord struct {
+	TransferID  int       `json:"transferID"`
+	CommP       cid.Cid   `json:"commP"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError"`
+}
+
+// RejectedOffer records an offer that was never added to the pending set
+type RejectedOffer struct {
+	OfferID  uint64    `json:"offerID"`
+	Offer    Offer     `json:"offer"`
+	Reason   string    `json:"reason"`
+	Rejected time.Time `json:"rejected"`
+}
+
+// boltStore is a StateStore backed by a single BoltDB file
+type boltStore struct {
+	db *bolt.DB
+}
+
+var _ StateStore = (*boltStore)(nil)
+
+func OpenStateStore(path string) (*boltStore, error) {
+	if path == "" {
+		path = defaultStatePath
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	// Fail fast instead of blocking forever if another daemon holds the file lock
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state db %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{pendingBucket, aggregateBucket, metaBucket, dealBucket, retryBucket, rejectedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize state db: %w", err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) PutPending(event DataReadyEvent) error {
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal offer %d: %w", event.OfferID, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingBucket).Put(uint64Key(event.OfferID), bs)
+	})
+}
+
+func (s *boltStore) DeletePending(offerID uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingBucket).Delete(uint64Key(offerID))
+	})
+}
+
+func (s *boltStore) Pending() ([]DataReadyEvent, error) {
+	var events []DataReadyEvent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingBucket).ForEach(func(k, v []byte) error {
+			var event DataReadyEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				return fmt.Errorf("failed to unmarshal pending offer %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			events = append(events, event)
+			return nil
+		})
+	})
+	return events, err
+}
+
+func (s *boltStore) CommitAggregate(rec *AggregateRecord) (int, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(aggregateBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		rec.TransferID = int(seq)
+		bs, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("failed to marshal aggregate %s: %w", rec.CommP, err)
+		}
+		if err := b.Put(uint64Key(seq), bs); err != nil {
+			return err
+		}
+		pending := tx.Bucket(pendingBucket)
+		for _, id := range rec.OfferIDs {
+			if err := pending.Delete(uint64Key(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rec.TransferID, nil
+}
+
+func (s *boltStore) Aggregates() ([]AggregateRecord, error) {
+	var recs []AggregateRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(aggregateBucket).ForEach(func(k, v []byte) error {
+			var rec AggregateRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("failed to unmarshal aggregate %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			recs = append(recs, rec)
+			return nil
+		})
+	})
+	return recs, err
+}
+
+func (s *boltStore) PutDeal(deal DealRecord) error {
+	bs, err := json.Marshal(deal)
+	if err != nil {
+		return fmt.Errorf("failed to marshal deal %s: %w", deal.UUID, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dealBucket).Put(deal.UUID[:], bs)
+	})
+}
+
+func (s *boltStore) Deals(transferID int) ([]DealRecord, error) {
+	all, err := s.AllDeals()
+	if err != nil {
+		return nil, err
+	}
+	var deals []DealRecord
+	for _, deal := range all {
+		if deal.TransferID == transferID {
+			deals = append(deals, deal)
+		}
+	}
+	return deals, nil
+}
+
+func (s *boltStore) AllDeals() ([]DealRecord, error) {
+	var deals []DealRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(dealBucket).ForEach(func(k, v []byte) error {
+			var deal DealRecord
+			if err := json.Unmarshal(v, &deal); err != nil {
+				return fmt.Errorf("failed to unmarshal deal %x: %w", k, err)
+			}
+			deals = append(deals, deal)
+			return nil
+		})
+	})
+	return deals, err
+}
+
+func (s *boltStore) PutRetry(rec RetryRecord) error {
+	bs, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal retry for transfer %d: %w", rec.TransferID, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(retryBucket).Put(uint64Key(uint64(rec.TransferID)), bs)
+	})
+}
+
+func (s *boltStore) Retry(transferID int) (*RetryRecord, error) {
+	var rec *RetryRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(retryBucket).Get(uint64Key(uint64(transferID)))
+		if v == nil {
+			return nil
+		}
+		rec = new(RetryRecord)
+		return json.Unmarshal(v, rec)
+	})
+	return rec, err
+}
+
+func (s *boltStore) DeleteRetry(transferID int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(retryBucket).Delete(uint64Key(uint64(transferID)))
+	})
+}
+
+func (s *boltStore) Retries() ([]RetryRecord, error) {
+	var recs []RetryRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(retryBucket).ForEach(func(k, v []byte) error {
+			var rec RetryRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("failed to unmarshal retry %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			recs = append(recs, rec)
+			return nil
+		})
+	})
+	return recs, err
+}
+
+func (s *boltStore) PutRejected(rec RejectedOffer) error {
+	bs, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal rejected offer %d: %w", rec.OfferID, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(rejectedBucket).Put(uint64Key(rec.OfferID), bs)
+	})
+}
+
+func (s *boltStore) Rejected() ([]RejectedOffer, error) {
+	var recs []RejectedOffer
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(rejectedBucket).ForEach(func(k, v []byte) error {
+			var rec RejectedOffer
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("failed to unmarshal rejected offer %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			recs = append(recs, rec)
+			return nil
+		})
+	})
+	return recs, err
+}
+
+func (s *boltStore) SetCursor(block uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(cursorKey, uint64Key(block))
+	})
+}
+
+func (s *boltStore) Cursor() (uint64, bool, error) {
+	var block uint64
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(metaBucket).Get(cursorKey)
+		if v == nil {
+			return nil
+		}
+		if len(v) != 8 {
+			return fmt.Errorf("invalid cursor value %x", v)
+		}
+		block, ok = binary.BigEndian.Uint64(v), true
+		return nil
+	})
+	return block, ok, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// Big endian keys keep bolt's byte ordered iteration in numeric order
+func uint64Key(n uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, n)
+	return k
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEvent(id uint64, size uint64) DataReadyEvent {
+	return DataReadyEvent{
+		OfferID: id,
+		Offer: Offer{
+			CommP:    cid.MustParse(prefixCARCid).Bytes(),
+			Size:     size,
+			Location: "http://localhost:5077/get?id=1",
+			Amount:   big.NewInt(100),
+			Token:    common.HexToAddress("0x0C0FFEEC0FFEEC0FFEEC0FFEEC0FFEEC0FEECAFE"),
+		},
+	}
+}
+
+// State written before a restart must be readable after reopening the store
+func TestStateStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	store, err := OpenStateStore(path)
+	require.NoError(t, err)
+
+	for _, id := range []uint64{3, 1, 2, 4} {
+		require.NoError(t, store.PutPending(testEvent(id, 256)))
+	}
+	require.NoError(t, store.DeletePending(4))
+
+	_, ok, err := store.Cursor()
+	require.NoError(t, err)
+	assert.False(t, ok)
+	require.NoError(t, store.SetCursor(1234))
+
+	event := testEvent(1, 256)
+	piece, err := event.Offer.Piece()
+	require.NoError(t, err)
+	rec := &AggregateRecord{
+		CommP:     cid.MustParse(prefixCARCid),
+		DealSize:  1 << 20,
+		Pieces:    []filabi.PieceInfo{piece, piece},
+		OfferIDs:  []uint64{1, 2},
+		Locations: []string{"http://a", "http://b"},
+	}
+	transferID, err := store.CommitAggregate(rec)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	store, err = OpenStateStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	pending, err := store.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, uint64(3), pending[0].OfferID)
+	assert.Equal(t, testEvent(3, 256), pending[0])
+
+	cursor, ok, err := store.Cursor()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1234), cursor)
+
+	recs, err := store.Aggregates()
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	assert.Equal(t, transferID, recs[0].TransferID)
+	assert.Equal(t, rec.CommP, recs[0].CommP)
+	assert.Equal(t, rec.Pieces, recs[0].Pieces)
+	assert.Equal(t, rec.OfferIDs, recs[0].OfferIDs)
+	assert.Equal(t, rec.Locations, recs[0].Locations)
+
+	// Transfer IDs keep increasing across restarts
+	next, err := store.CommitAggregate(&AggregateRecord{CommP: rec.CommP, DealSize: rec.DealSize})
+	require.NoError(t, err)
+	assert.Greater(t, next, transferID)
+
+	_, err = recs[0].transfer()
+	assert.NoError(t, err)
+}
+
+func TestStateStoreDeals(t *testing.T) {
+	store, err := OpenStateStore(filepath.Join(t.TempDir(), "state.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	accepted := DealRecord{UUID: uuid.New(), TransferID: 1, CommP: cid.MustParse(prefixCARCid), Provider: "t01000", State: DealStateAccepted}
+	rejected := DealRecord{UUID: uuid.New(), TransferID: 1, CommP: cid.MustParse(prefixCARCid), Provider: "t01001", State: DealStateRejected, Message: "no"}
+	other := DealRecord{UUID: uuid.New(), TransferID: 2, CommP: cid.MustParse(prefixCARCid), Provider: "t01000", State: DealStateAccepted}
+	for _, deal := range []DealRecord{accepted, rejected, other} {
+		require.NoError(t, store.PutDeal(deal))
+	}
+
+	deals, err := store.Deals(1)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []DealRecord{accepted, rejected}, deals)
+
+	// Updating a deal replaces it
+	rejected.State = DealStateAccepted
+	require.NoError(t, store.PutDeal(rejected))
+	deals, err = store.Deals(1)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []DealRecord{accepted, rejected}, deals)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Random bearer token a provider fetches an aggregate with
+func newTransferToken() string {
+	bs := make([]byte, 32)
+	if _, err := rand.Read(bs); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %s", err))
+	}
+	return hex.EncodeToString(bs)
+}
+
+// Let the holder of token download the aggregate with the given transfer ID
+func (a *aggregator) allowTransfer(token string, transferID int) {
+	a.transferLk.Lock()
+	defer a.transferLk.Unlock()
+	a.transferTokens[token] = transferID
+}
+
+// Stop serving the holder of token, once its deal is active or has failed
+func (a *aggregator) revokeTransfer(token string) {
+	a.transferLk.Lock()
+	defer a.transferLk.Unlock()
+	delete(a.transferTokens, token)
+}
+
+// Reports whether the request carries a bearer token for the transfer.
+// Tokens are compared in full so requests cannot probe for other transfers.
+func (a *aggregator) authorizedTransfer(r *http.Request, transferID int) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	a.transferLk.RLock()
+	defer a.transferLk.RUnlock()
+	id, ok := a.transferTokens[token]
+	return ok && id == transferID
+}
+
+// TransferTokenResponse is what a provider needs to download its deal's
+// aggregate out of band, e.g. when importing a ddo deal
+type TransferTokenResponse struct {
+	UUID     uuid.UUID `json:"uuid"`
+	Provider string    `json:"provider"`
+	URL      string    `json:"url"`
+	Token    string    `json:"token"`
+}
+
+// Hand the transfer token of one deal to the operator to pass on to its
+// provider. Only admin requests carrying the configured AdminToken may read
+// tokens, the rest of the admin API redacts them.
+func (a *aggregator) transferTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeAdmin(w, r, a.adminToken, "transfer tokens cannot be read") {
+		return
+	}
+	id, err := uuid.Parse(r.URL.Query().Get("deal"))
+	if err != nil {
+		http.Error(w, "Invalid deal UUID", http.StatusBadRequest)
+		return
+	}
+	deals, err := a.store.AllDeals()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, deal := range deals {
+		if deal.UUID != id {
+			continue
+		}
+		if !deal.transferAllowed() {
+			http.Error(w, fmt.Sprintf("deal %s is %s, its provider may not download the aggregate", id, deal.State), http.StatusConflict)
+			return
+		}
+		writeJSON(w, TransferTokenResponse{
+			UUID:     deal.UUID,
+			Provider: deal.Provider,
+			URL:      a.transferURL(deal.TransferID),
+			Token:    deal.TransferToken,
+		})
+		return
+	}
+	http.Error(w, fmt.Sprintf("deal %s not found", id), http.StatusNotFound)
+}
+
+// A contiguous span of the unpadded aggregate stream backed by one source.
+// Bytes between segments are zero.
+type aggregateSegment struct {
+	offset int64
+	length int64
+	// Open the segment's source skipping the first skip bytes. Sources may be
+	// shorter than the segment, the rest of the segment is zero filled.
+	open func(skip int64) io.ReadCloser
+}
+
+// Lay out the segments of a transfer's aggregate stream from its index,
+// reading sub pieces from staging when it is set
+func (t *AggregateTransfer) segments(staging *stagingArea) ([]aggregateSegment, error) {
+	prefixCARBytes, err := hex.DecodeString(prefixCAR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode CAR prefix: %w", err)
+	}
+	entries := t.agg.Index.Entries
+	if len(entries) != len(t.locations)+1 {
+		return nil, fmt.Errorf("aggregate has %d entries for %d locations", len(entries), len(t.locations))
+	}
+	segments := make([]aggregateSegment, 0, len(entries)+1)
+	for i, entry := range entries {
+		seg := aggregateSegment{
+			offset: int64(entry.UnpaddedOffest()),
+			length: int64(entry.UnpaddedLength()),
+		}
+		switch {
+		case i == 0:
+			seg.open = bytesSource(prefixCARBytes)
+		case staging != nil && i-1 < len(t.offerIDs):
+			seg.open = staging.source(t.offerIDs[i-1], t.locations[i-1])
+		default:
+			url := t.locations[i-1]
+			seg.open = func(skip int64) io.ReadCloser {
+				return &lazyHTTPReader{url: url, offset: skip}
+			}
+		}
+		segments = append(segments, seg)
+	}
+
+	indexReader, err := t.agg.IndexReader()
+	if err != nil {
+		return nil, err
+	}
+	index, err := io.ReadAll(indexReader)
+	if err != nil {
+		return nil, err
+	}
+	indexStart, err := t.agg.IndexStartPosition()
+	if err != nil {
+		return nil, err
+	}
+	indexSize, err := t.agg.IndexSize()
+	if err != nil {
+		return nil, err
+	}
+	segments = append(segments, aggregateSegment{
+		offset: int64(indexStart),
+		length: int64(indexSize.Unpadded()),
+		open:   bytesSource(index),
+	})
+	return segments, nil
+}
+
+func bytesSource(bs []byte) func(skip int64) io.ReadCloser {
+	return func(skip int64) io.ReadCloser {
+		if skip > int64(len(bs)) {
+			skip = int64(len(bs))
+		}
+		return io.NopCloser(bytes.NewReader(bs[skip:]))
+	}
+}
+
+// aggregateReader is an io.ReadSeeker over the unpadded aggregate stream.
+// Sources are only opened when a read reaches their segment, so serving a
+// range only fetches the buffer locations that overlap it.
+type aggregateReader struct {
+	segments []aggregateSegment
+	size     int64
+	pos      int64
+	cur      io.Reader // reads from pos onwards, nil until the next Read
+	closers  []io.Closer
+}
+
+func newAggregateReader(t *AggregateTransfer, staging *stagingArea) (*aggregateReader, error) {
+	segments, err := t.segments(staging)
+	if err != nil {
+		return nil, err
+	}
+	return &aggregateReader{
+		segments: segments,
+		size:     int64(t.agg.DealSize.Unpadded()),
+	}, nil
+}
+
+func (r *aggregateReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.cur == nil {
+		r.cur = r.readFrom(r.pos)
+	}
+	n, err := r.cur.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *aggregateReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != r.pos {
+		r.closeSources()
+		r.cur = nil
+		r.pos = offset
+	}
+	return offset, nil
+}
+
+func (r *aggregateReader) Close() error {
+	r.closeSources()
+	return nil
+}
+
+func (r *aggregateReader) closeSources() {
+	for _, c := range r.closers {
+		c.Close()
+	}
+	r.closers = nil
+}
+
+// Chain readers for the rest of the stream starting at pos
+func (r *aggregateReader) readFrom(pos int64) io.Reader {
+	var readers []io.Reader
+	for _, seg := range r.segments {
+		end := seg.offset + seg.length
+		if end <= pos {
+			continue
+		}
+		skip := int64(0)
+		if seg.offset > pos {
+			readers = append(readers, io.LimitReader(zeros{}, seg.offset-pos))
+		} else {
+			skip = pos - seg.offset
+		}
+		src := &lazySource{open: seg.open, skip: skip}
+		r.closers = append(r.closers, src)
+		readers = append(readers, io.LimitReader(io.MultiReader(src, zeros{}), seg.length-skip))
+		pos = end
+	}
+	if pos < r.size {
+		readers = append(readers, io.LimitReader(zeros{}, r.size-pos))
+	}
+	return io.MultiReader(readers...)
+}
+
+// lazySource opens a segment's source on first read
+type lazySource struct {
+	open func(skip int64) io.ReadCloser
+	skip int64
+	rc   io.ReadCloser
+}
+
+func (s *lazySource) Read(p []byte) (int, error) {
+	if s.rc == nil {
+		s.rc = s.open(s.skip)
+	}
+	return s.rc.Read(p)
+}
+
+func (s *lazySource) Close() error {
+	if s.rc != nil {
+		return s.rc.Close()
+	}
+	return nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
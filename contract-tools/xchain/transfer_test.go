@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-data-segment/datasegment"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Buffer server with per path request counts
+type testBuffer struct {
+	mu       sync.Mutex
+	data     map[string][]byte
+	requests map[string]int
+}
+
+func (b *testBuffer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	b.requests[r.URL.Path]++
+	data := b.data[r.URL.Path]
+	b.mu.Unlock()
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func testTransfer(t *testing.T) (*AggregateTransfer, *testBuffer, []byte) {
+	rng := rand.New(rand.NewSource(7))
+	buf := &testBuffer{data: make(map[string][]byte), requests: make(map[string]int)}
+	srv := httptest.NewServer(buf)
+	t.Cleanup(srv.Close)
+
+	pieces := []filabi.PieceInfo{prefixPiece}
+	var locations []string
+	prefixCARBytes, err := hex.DecodeString(prefixCAR)
+	require.NoError(t, err)
+	readers := []io.Reader{bytes.NewReader(prefixCARBytes)}
+	for i, size := range []uint64{32 << 10, 128 << 10} {
+		// Sub piece data shorter than its padded size is zero filled
+		data := make([]byte, filabi.PaddedPieceSize(size).Unpadded()-100)
+		rng.Read(data)
+		path := fmt.Sprintf("/piece%d", i)
+		buf.data[path] = data
+		locations = append(locations, srv.URL+path)
+		readers = append(readers, bytes.NewReader(data))
+		pieceCID := testPieceCID(t, data, filabi.PaddedPieceSize(size))
+		pieces = append(pieces, filabi.PieceInfo{Size: filabi.PaddedPieceSize(size), PieceCID: pieceCID})
+	}
+	agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(1<<20), pieces)
+	require.NoError(t, err)
+	full, err := agg.AggregateObjectReader(readers)
+	require.NoError(t, err)
+	expected, err := io.ReadAll(full)
+	require.NoError(t, err)
+	return &AggregateTransfer{locations: locations, agg: agg}, buf, expected
+}
+
+func TestAggregateReaderMatchesObjectReader(t *testing.T) {
+	transfer, _, expected := testTransfer(t)
+	r, err := newAggregateReader(transfer, nil)
+	require.NoError(t, err)
+	defer r.Close()
+	actual, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestTransferHandlerRange(t *testing.T) {
+	transfer, buf, expected := testTransfer(t)
+	a := &aggregator{
+		transfers:      map[int]AggregateTransfer{1: *transfer},
+		transferTokens: map[string]int{"secret": 1},
+	}
+
+	get := func(rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?id=1", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		a.transferHandler(rec, req)
+		return rec
+	}
+
+	// A range inside the second sub piece only fetches its location
+	offset := int(transfer.agg.Index.Entries[2].UnpaddedOffest()) + 1000
+	rec := get(fmt.Sprintf("bytes=%d-%d", offset, offset+4095))
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, expected[offset:offset+4096], rec.Body.Bytes())
+	assert.Equal(t, map[string]int{"/piece1": 1}, buf.requests)
+
+	// Resuming from the middle of the stream returns the rest of it
+	rec = get(fmt.Sprintf("bytes=%d-", 5000))
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, expected[5000:], rec.Body.Bytes())
+
+	rec = get("")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, fmt.Sprint(len(expected)), rec.Header().Get("Content-Length"))
+	assert.Equal(t, expected, rec.Body.Bytes())
+
+	rec = get(fmt.Sprintf("bytes=%d-", len(expected)))
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+}
+
+func TestTransferHandlerRequiresToken(t *testing.T) {
+	transfer, _, _ := testTransfer(t)
+	a := &aggregator{
+		transfers:      map[int]AggregateTransfer{1: *transfer, 2: *transfer},
+		transferTokens: map[string]int{},
+	}
+	token := newTransferToken()
+	a.allowTransfer(token, 1)
+
+	status := func(id int, auth string) int {
+		req := httptest.NewRequest(http.MethodHead, fmt.Sprintf("/?id=%d", id), nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		a.transferHandler(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, status(1, "Bearer "+token))
+	assert.Equal(t, http.StatusUnauthorized, status(1, ""))
+	assert.Equal(t, http.StatusUnauthorized, status(1, "Bearer wrong"))
+	// Tokens only grant access to the transfer their deal is for
+	assert.Equal(t, http.StatusUnauthorized, status(2, "Bearer "+token))
+
+	// Activated deals can no longer download
+	a.revokeTransfer(token)
+	assert.Equal(t, http.StatusUnauthorized, status(1, "Bearer "+token))
+}
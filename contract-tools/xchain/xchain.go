@@ -3,16 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/big"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -37,19 +39,15 @@ import (
 	inet "github.com/libp2p/go-libp2p/core/network"
 
 	filabi "github.com/filecoin-project/go-state-types/abi"
-	fbig "github.com/filecoin-project/go-state-types/big"
 	builtintypes "github.com/filecoin-project/go-state-types/builtin"
 	"github.com/filecoin-project/go-state-types/builtin/v9/market"
 	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/lotus/api/v0api"
 	lotustypes "github.com/filecoin-project/lotus/chain/types"
-	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/mitchellh/go-homedir"
-	"github.com/multiformats/go-multiaddr"
 	"github.com/urfave/cli/v2"
 )
 
@@ -80,6 +78,10 @@ func main() {
 						Usage: "Run an aggregation server",
 						Value: false,
 					},
+					&cli.Uint64Flag{
+						Name:  "from-block",
+						Usage: "Replay DataReady events starting at this block instead of the last processed block",
+					},
 				},
 				Action: func(cctx *cli.Context) error {
 					isBuffer := cctx.Bool("buffer-service")
@@ -110,8 +112,26 @@ func main() {
 						if err != nil {
 							return &http.MaxBytesError{}
 						}
-						http.HandleFunc("/put", srv.PutHandler)
-						http.HandleFunc("/get", srv.GetHandler)
+						http.HandleFunc("/put", countBufferRequests("put", srv.PutHandler))
+						http.HandleFunc("/get", countBufferRequests("get", srv.GetHandler))
+						http.HandleFunc("/piece/", countBufferRequests("piece", srv.PieceHandler))
+
+						// Drop data once its aggregate is proven on chain
+						var onramp onRampReader
+						if cfg.Api != "" && cfg.OnRampAddress != "" {
+							reader, err := newOnRampReader(cfg)
+							if err != nil {
+								return fmt.Errorf("failed to read onramp contract for buffer gc: %w", err)
+							}
+							onramp = reader
+						}
+						ttl := time.Duration(cfg.BufferTTL) * time.Second
+						http.HandleFunc("/gc", srv.GCHandler(onramp, ttl, cfg.BufferGCDryRun, cfg.AdminToken))
+						if interval := cfg.bufferGCInterval(); interval <= 0 || onramp == nil {
+							log.Printf("buffer gc disabled, data is kept until removed with `xchain buffer gc`")
+						} else {
+							go srv.runGC(ctx, onramp, interval, ttl, cfg.BufferGCDryRun)
+						}
 
 						fmt.Printf("Server starting on port %d\n", cfg.BufferPort)
 						server := &http.Server{
@@ -128,6 +148,12 @@ func main() {
 						// Context is cancelled, shut down the server
 						return server.Shutdown(context.Background())
 					})
+					g.Go(func() error {
+						if cfg.MetricsPort == 0 {
+							return nil
+						}
+						return serveMetrics(ctx, cfg.MetricsPort)
+					})
 					g.Go(func() error {
 						if !isAgg {
 							return nil
@@ -136,11 +162,143 @@ func main() {
 						if err != nil {
 							return err
 						}
+						if cctx.IsSet("from-block") {
+							fromBlock := cctx.Uint64("from-block")
+							a.fromBlock = &fromBlock
+						}
 						return a.run(ctx)
 					})
 					return g.Wait()
 				},
 			},
+			{
+				Name:  "deals",
+				Usage: "Manage storage deals for committed aggregates",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "retry",
+						Usage:     "Propose an aggregate to storage providers again, resetting its retry attempts",
+						ArgsUsage: "<aggregate transfer ID or commP>",
+						Action: func(cctx *cli.Context) error {
+							if cctx.Args().Len() != 1 {
+								return fmt.Errorf("expected exactly one aggregate")
+							}
+							cfg, err := LoadConfig(cctx.String("config"))
+							if err != nil {
+								log.Fatal(err)
+							}
+							var resp RetryResponse
+							query := url.Values{"aggregate": {cctx.Args().First()}}
+							if err := adminRequest(cctx.Context, cfg, http.MethodPost, "/deals/retry?"+query.Encode(), &resp); err != nil {
+								return err
+							}
+							for _, deal := range resp.Deals {
+								fmt.Printf("%s\t%s\t%s\t%s\n", deal.UUID, deal.Provider, deal.State, deal.Message)
+							}
+							if resp.Error != "" {
+								return fmt.Errorf("retry failed: %s", resp.Error)
+							}
+							return nil
+						},
+					},
+					{
+						Name:      "transfer-token",
+						Usage:     "Print the URL and bearer token a deal's provider downloads its aggregate with, e.g. to import a ddo deal",
+						ArgsUsage: "<deal UUID>",
+						Action: func(cctx *cli.Context) error {
+							if cctx.Args().Len() != 1 {
+								return fmt.Errorf("expected exactly one deal")
+							}
+							cfg, err := LoadConfig(cctx.String("config"))
+							if err != nil {
+								log.Fatal(err)
+							}
+							var resp TransferTokenResponse
+							query := url.Values{"deal": {cctx.Args().First()}}
+							if err := adminRequest(cctx.Context, cfg, http.MethodGet, "/deals/transfer-token?"+query.Encode(), &resp); err != nil {
+								return err
+							}
+							fmt.Printf("Provider:\t%s\nURL:\t%s\nHeader:\tAuthorization: Bearer %s\n", resp.Provider, resp.URL, resp.Token)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "buffer",
+				Usage: "Manage data stored by the buffer service",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "gc",
+						Usage: "Remove buffered data whose aggregates are proven on chain and uploads never offered within BufferTTL",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "List what would be removed without removing it",
+							},
+							&cli.StringFlag{
+								Name:  "buffer-addr",
+								Usage: "Address of the running buffer service, defaults to 127.0.0.1:BufferPort",
+							},
+						},
+						Action: func(cctx *cli.Context) error {
+							cfg, err := LoadConfig(cctx.String("config"))
+							if err != nil {
+								log.Fatal(err)
+							}
+							// The buffer service collects so removals never race its uploads
+							addr := cctx.String("buffer-addr")
+							if addr == "" {
+								addr = fmt.Sprintf("127.0.0.1:%d", cfg.BufferPort)
+							}
+							path := "/gc"
+							if cctx.Bool("dry-run") {
+								path += "?dry-run=true"
+							}
+							var result BufferGCResult
+							if err := daemonRequest(cctx.Context, cfg, addr, http.MethodPost, path, &result); err != nil {
+								return err
+							}
+							verb := "removed"
+							if result.DryRun {
+								verb = "would remove"
+							}
+							for _, f := range result.Removed {
+								fmt.Printf("%s %s (%d bytes): %s\n", verb, f.Name, f.Size, f.Reason)
+							}
+							fmt.Printf("%d files %s, %d kept\n", len(result.Removed), verb, result.Kept)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "status",
+				Usage: "Show pending offers, committed aggregates, deals and rejected offers of the running daemon",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the raw status as JSON",
+					},
+				},
+				Action: func(cctx *cli.Context) error {
+					cfg, err := LoadConfig(cctx.String("config"))
+					if err != nil {
+						log.Fatal(err)
+					}
+					var status StatusResponse
+					if err := adminRequest(cctx.Context, cfg, http.MethodGet, "/status", &status); err != nil {
+						return err
+					}
+					if cctx.Bool("json") {
+						enc := json.NewEncoder(os.Stdout)
+						enc.SetIndent("", "  ")
+						return enc.Encode(status)
+					}
+					printStatus(os.Stdout, status)
+					return nil
+				},
+			},
 			{
 				Name:  "client",
 				Usage: "Send data from cross chain to filecoin",
@@ -239,6 +397,48 @@ type Config struct {
 	ProviderAddr  string
 	LotusAPI      string
 	TargetAggSize int
+	StatePath     string // BoltDB file for aggregator state, defaults to ~/.xchain/state.db
+	StagingPath   string // directory accepted offer data is staged in, defaults to ~/.xchain/staging
+	StagingQuota  uint64 // max bytes of staged offer data, 0 for no limit
+	// Seconds one download of an offer's data may take, defaults to an hour
+	StagingTimeout int
+	// Number of blocks a DataReady event must be buried under before it is aggregated
+	ConfirmationDepth uint64
+	// How DataReady logs are read: "subscribe" or "poll", chosen from the Api URL scheme when empty
+	LogSource       string
+	LogPollInterval int // seconds between polls, defaults to 10
+	// How offers are packed into aggregates: "greedy" (default), "best-fit" or "hold-large"
+	PackingStrategy string
+	PackingWindow   int    // offers best-fit looks ahead past the first overflow, defaults to 32
+	PackingHoldSize uint64 // min size of offers held back by hold-large, defaults to 1/8th of TargetAggSize
+	// Seal an aggregate once its oldest offer has waited this many seconds, 0 waits for the aggregate to fill
+	MaxAggregateWait int
+	// Fraction of TargetAggSize pending offers must fill before a deadline seal, 0 seals anything
+	MinAggregateFill float64
+	// Storage providers to replicate aggregates to, in order of preference. Defaults to ProviderAddr
+	Providers         []string
+	ReplicationFactor int // number of providers that should store each aggregate, defaults to 1
+	DealPollInterval  int // seconds between deal status checks, defaults to 5 minutes
+	MaxDealAttempts   int // times to propose an aggregate before giving up, defaults to 10
+	// Local address of the admin API used by xchain commands, defaults to 127.0.0.1:1729
+	AdminAddr string
+	// Bearer token xchain commands send to the admin API and buffer, required to
+	// read transfer tokens, retry deals and run buffer gc on request
+	AdminToken string
+	// Terms deals are proposed on, with overrides by provider address
+	DealTerms         DealTerms
+	ProviderDealTerms map[string]DealTerms
+	// Lotus wallet holding the DataCap allocated to providers on the ddo deal path
+	DDOClient string
+	// Lotus API token, needs sign permission for the ddo deal path
+	LotusToken  string
+	MetricsPort int // port to serve Prometheus metrics on at /metrics, 0 to disable
+	// Seconds between buffer garbage collections, defaults to an hour, negative to disable
+	BufferGCInterval int
+	BufferTTL        int  // seconds never offered uploads are kept, 0 keeps them forever
+	BufferGCDryRun   bool // only log what buffer GC would remove
+	// Which offers are accepted for aggregation, all offers by default
+	Admission AdmissionPolicy
 }
 
 // Mirror OnRamp.sol's `Offer` struct
@@ -267,22 +467,46 @@ func (o *Offer) Piece() (filabi.PieceInfo, error) {
 
 type aggregator struct {
 	client         *ethclient.Client         // raw client for log subscriptions
+	receipts       bind.DeployBackend        // receipts of sent transactions
+	source         LogSource                 // subscription or polling source of DataReady logs
 	onramp         *bind.BoundContract       // onramp binding over raw client for message sending
 	auth           *bind.TransactOpts        // auth for message sending
 	abi            *abi.ABI                  // onramp abi for log subscription and message sending
 	onrampAddr     common.Address            // onramp address for log subscription
 	proverAddr     common.Address            // prover address for client contract deal
 	payoutAddr     common.Address            // aggregator payout address for receiving funds
-	ch             chan DataReadyEvent       // pass events to seperate goroutine for processing
+	ch             chan aggregationMsg       // pass events to seperate goroutine for processing
+	confirmations  *confirmationQueue        // DataReady logs waiting for confirmation depth
 	transfers      map[int]AggregateTransfer // track aggregate data awaiting transfer
-	transferLk     sync.RWMutex              // Mutex protecting transfers map
-	transferID     int                       // ID of the next transfer
+	transferLk     sync.RWMutex              // Mutex protecting transfers and transferTokens maps
+	transferTokens map[string]int            // bearer token to the transfer ID its provider may download
+	staging        *stagingArea              // local copies of accepted offer data
+	staged         chan *stagingJob          // offers whose staging finished, back to aggregation
+	inflight       map[uint64]*stagingJob    // offers being staged, owned by aggregation
+	stagingWG      sync.WaitGroup            // staging workers, waited for when aggregation stops
+	admission      *admissionPolicy          // decides which offers are passed to aggregation
 	transferAddr   string                    // address to listen for transfer requests
 	targetDealSize uint64                    // how big aggregates should be
 	host           host.Host                 // libp2p host for deal protocol to boost
-	spDealAddr     *peer.AddrInfo            // address to reach boost (or other) deal v 1.2 provider
-	spActorAddr    address.Address           // address of the storage provider actor
+	providers      []*storageProvider        // storage providers to propose deals to, in order of preference
+	replication    int                       // number of providers each aggregate should be stored by
+	dealLk         sync.Mutex                // serializes proposals so replicas are not double counted
+	dealPoll       time.Duration             // how often to check on proposed deals
+	maxAttempts    int                       // proposal attempts per aggregate before giving up
+	adminAddr      string                    // local address to serve the admin API on
+	adminToken     string                    // bearer token for admin requests that reveal secrets
+	ddoClient      address.Address           // lotus wallet allocating DataCap for ddo deals
 	lotusAPI       v0api.FullNode            // Lotus API for determining deal start epoch and collateral bounds
+	store          StateStore                // durable pending offers and committed aggregates
+	pending        []DataReadyEvent          // pending offers rehydrated from the store on startup
+	packing        PackingStrategy           // decides which pending offers make up the next aggregate
+	maxWait        time.Duration             // deadline for sealing a partially full aggregate, 0 to disable
+	minFill        float64                   // fraction of targetDealSize required for a deadline seal
+	seen           map[uint64]struct{}       // offer IDs already passed to aggregation, for deduplicating replayed logs
+	reverted       []*revertedCommit         // aggregates whose commit reverted, owned by aggregation
+	fromBlock      *uint64                   // block to start the first backfill from, overriding the stored cursor
+	handled        uint64                    // last block whose logs reached aggregation, owned by aggregation
+	cursor         uint64                    // last block persisted as fully handled, owned by aggregation
 	cleanup        func()                    // cleanup function to call on shutdown
 }
 
@@ -332,6 +556,15 @@ func NewAggregator(ctx context.Context, cfg *Config) (*aggregator, error) {
 		log.Fatal(err)
 	}
 
+	source, err := NewLogSource(cfg, client)
+	if err != nil {
+		return nil, err
+	}
+	packing, err := NewPackingStrategy(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	parsedABI, err := LoadAbi(cfg.OnRampABIPath)
 	if err != nil {
 		return nil, err
@@ -351,59 +584,162 @@ func NewAggregator(ctx context.Context, cfg *Config) (*aggregator, error) {
 		return nil, err
 	}
 
-	lAPI, closer, err := NewLotusDaemonAPIClientV0(ctx, cfg.LotusAPI, 1, "")
+	lAPI, closer, err := NewLotusDaemonAPIClientV0(ctx, cfg.LotusAPI, 1, cfg.LotusToken)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get maddr for dialing boost from on chain miner actor
-	providerAddr, err := address.NewFromString(cfg.ProviderAddr)
+	// Get maddrs for dialing boost from on chain miner actors
+	var providers []*storageProvider
+	for _, addr := range cfg.providerAddrs() {
+		sp, err := resolveProvider(ctx, lAPI, addr)
+		if err != nil {
+			return nil, err
+		}
+		if sp.terms, err = cfg.dealTerms(addr); err != nil {
+			return nil, err
+		}
+		providers = append(providers, sp)
+	}
+	for addr := range cfg.ProviderDealTerms {
+		if !slices.Contains(cfg.providerAddrs(), addr) {
+			return nil, fmt.Errorf("deal terms set for %s which is not a configured provider", addr)
+		}
+	}
+	ddoClient := address.Undef
+	if cfg.DDOClient != "" {
+		if ddoClient, err = address.NewFromString(cfg.DDOClient); err != nil {
+			return nil, fmt.Errorf("failed to parse DDO client address: %w", err)
+		}
+	}
+	for _, sp := range providers {
+		if sp.terms.path == DealPathDDO && ddoClient == address.Undef {
+			return nil, fmt.Errorf("provider %s uses the ddo deal path but no DDOClient is configured", sp.actor)
+		}
+	}
+	replication := cfg.ReplicationFactor
+	if replication <= 0 {
+		replication = 1
+	}
+	if replication > len(providers) {
+		return nil, fmt.Errorf("replication factor %d exceeds the %d configured providers", replication, len(providers))
+	}
+	dealPoll := time.Duration(cfg.DealPollInterval) * time.Second
+	if dealPoll <= 0 {
+		dealPoll = defaultDealPollInterval
+	}
+	maxAttempts := cfg.MaxDealAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxDealAttempts
+	}
+
+	admission, err := cfg.Admission.validate()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse provider address: %w", err)
+		return nil, fmt.Errorf("invalid admission policy: %w", err)
 	}
-	minfo, err := lAPI.StateMinerInfo(ctx, providerAddr, lotustypes.EmptyTSK)
+
+	// Rehydrate state left over from previous runs
+	staging, err := newStagingArea(cfg.StagingPath, cfg.StagingQuota)
 	if err != nil {
 		return nil, err
 	}
-	if minfo.PeerId == nil {
-		return nil, fmt.Errorf("sp has no peer id set on chain")
+	if cfg.StagingTimeout > 0 {
+		staging.timeout = time.Duration(cfg.StagingTimeout) * time.Second
 	}
-	var maddrs []multiaddr.Multiaddr
-	for _, mma := range minfo.Multiaddrs {
-		ma, err := multiaddr.NewMultiaddrBytes(mma)
+	store, err := OpenStateStore(cfg.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := store.Pending()
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to load pending offers: %w", err)
+	}
+	recs, err := store.Aggregates()
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to load committed aggregates: %w", err)
+	}
+	rejected, err := store.Rejected()
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to load rejected offers: %w", err)
+	}
+	seen := make(map[uint64]struct{})
+	for _, event := range pending {
+		seen[event.OfferID] = struct{}{}
+	}
+	// Replaying logs from the cursor must not reject offers again
+	for _, rec := range rejected {
+		seen[rec.OfferID] = struct{}{}
+	}
+	transfers := make(map[int]AggregateTransfer, len(recs))
+	for _, rec := range recs {
+		for _, id := range rec.OfferIDs {
+			seen[id] = struct{}{}
+		}
+		transfer, err := rec.transfer()
 		if err != nil {
-			return nil, fmt.Errorf("storage provider %s had invalid multiaddrs in their info: %w", providerAddr, err)
+			store.Close()
+			return nil, fmt.Errorf("failed to rebuild aggregate %s: %w", rec.CommP, err)
 		}
-		maddrs = append(maddrs, ma)
+		transfers[rec.TransferID] = transfer
 	}
-	if len(maddrs) == 0 {
-		return nil, fmt.Errorf("storage provider %s has no multiaddrs set on-chain", providerAddr)
+	deals, err := store.AllDeals()
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to load deals: %w", err)
 	}
-	psPeerInfo := &peer.AddrInfo{
-		ID:    *minfo.PeerId,
-		Addrs: maddrs,
+	transferTokens := make(map[string]int)
+	for _, deal := range deals {
+		if deal.transferAllowed() {
+			transferTokens[deal.TransferToken] = deal.TransferID
+		}
 	}
+	log.Printf("Loaded %d pending offers and %d committed aggregates from state store", len(pending), len(recs))
 
 	return &aggregator{
 		client:         client,
+		receipts:       client,
+		source:         source,
 		onramp:         onramp,
 		onrampAddr:     onRampContractAddress,
 		proverAddr:     proverContractAddress,
 		payoutAddr:     payoutAddress,
 		auth:           auth,
-		ch:             make(chan DataReadyEvent, 1024), // buffer many events since consumer sometimes waits for chain
-		transfers:      make(map[int]AggregateTransfer),
+		ch:             make(chan aggregationMsg, 1024), // buffer many events since consumer sometimes waits for chain
+		confirmations:  newConfirmationQueue(cfg.ConfirmationDepth),
+		transfers:      transfers,
 		transferLk:     sync.RWMutex{},
+		transferTokens: transferTokens,
+		staging:        staging,
+		staged:         make(chan *stagingJob),
+		inflight:       make(map[uint64]*stagingJob),
+		admission:      admission,
 		transferAddr:   fmt.Sprintf("%s:%d", cfg.TransferIP, cfg.TransferPort),
 		abi:            parsedABI,
 		targetDealSize: uint64(cfg.TargetAggSize),
 		host:           h,
-		spDealAddr:     psPeerInfo,
-		spActorAddr:    providerAddr,
+		providers:      providers,
+		replication:    replication,
 		lotusAPI:       lAPI,
+		store:          store,
+		pending:        pending,
+		packing:        packing,
+		maxWait:        time.Duration(cfg.MaxAggregateWait) * time.Second,
+		dealPoll:       dealPoll,
+		maxAttempts:    maxAttempts,
+		adminAddr:      cfg.adminAddr(),
+		adminToken:     cfg.AdminToken,
+		ddoClient:      ddoClient,
+		minFill:        cfg.MinAggregateFill,
+		seen:           seen,
 		cleanup: func() {
 			closer()
 			fmt.Printf("done with lotus api closer\n")
+			if err := store.Close(); err != nil {
+				log.Printf("failed to close state store: %s", err)
+			}
 		},
 	}, nil
 }
@@ -423,18 +759,25 @@ func (a *aggregator) run(ctx context.Context) error {
 			Topics:    [][]common.Hash{{a.abi.Events["DataReady"].ID}},
 		}
 
-		err := a.SubscribeQuery(ctx, query)
-		for err == nil || strings.Contains(err.Error(), "read tcp") {
-			if err != nil {
+		log.Printf("Listening for data ready events on %s\n", a.onrampAddr.Hex())
+		err := a.source.Run(ctx, query, a)
+		for err == nil || strings.Contains(err.Error(), "read tcp") || errors.Is(err, errRetryLogs) {
+			if errors.Is(err, errRetryLogs) {
+				log.Printf("[ERROR] %s, reading logs again from the cursor in %s", err, logRetryDelay)
+				select {
+				case <-ctx.Done():
+				case <-time.After(logRetryDelay):
+				}
+			} else if err != nil {
 				log.Printf("ignoring mystery error: %s", err)
 			}
 			if ctx.Err() != nil {
 				err = ctx.Err()
 				break
 			}
-			err = a.SubscribeQuery(ctx, query)
+			err = a.source.Run(ctx, query, a)
 		}
-		fmt.Printf("context done exiting subscribe query\n")
+		fmt.Printf("context done exiting log source\n")
 		return err
 	})
 
@@ -443,6 +786,26 @@ func (a *aggregator) run(ctx context.Context) error {
 		return a.runAggregate(ctx)
 	})
 
+	// Follow proposed deals through to activation
+	g.Go(func() error {
+		return a.trackDeals(ctx)
+	})
+
+	// Serve the local admin API
+	g.Go(func() error {
+		server := &http.Server{
+			Addr:    a.adminAddr,
+			Handler: a.adminHandler(),
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalf("Admin HTTP server ListenAndServe: %v", err)
+			}
+		}()
+		<-ctx.Done()
+		return server.Shutdown(context.Background())
+	})
+
 	// Start handling data transfer requests
 	g.Go(func() error {
 		http.HandleFunc("/", a.transferHandler)
@@ -482,160 +845,392 @@ const (
 	transferPort = 1728
 	// libp2p identifier for latest deal protocol
 	DealProtocolv120 = "/fil/storage/mk/1.2.0"
-	// Delay to start deal at. For 2k devnet 4 second block time this is 13.3 minutes TODO Config
-	dealDelayEpochs = 200
-	// Storage deal duration, TODO figure out what to do about this, either comes from offer or config
-	dealDuration = 518400 // 6 months (on mainnet)
+	// How often to check whether pending offers have passed the sealing deadline
+	sealCheckInterval = 30 * time.Second
+	// Commits of an aggregate that reverted before its offers are rejected
+	maxCommitAttempts = 5
+	// Backoff before committing a reverted aggregate again, doubling per attempt
+	commitRetryMin = time.Minute
 )
 
+// Piece of the prefix car, always the first piece of an aggregate
+var prefixPiece = filabi.PieceInfo{
+	Size:     filabi.PaddedPieceSize(prefixCARSizePadded),
+	PieceCID: cid.MustParse(prefixCARCid),
+}
+
+// errCommitReverted marks commitAggregate transactions that reverted
+var errCommitReverted = errors.New("commit reverted")
+
+// revertedCommit is an aggregate whose commit reverted, waiting for another attempt
+type revertedCommit struct {
+	events   []DataReadyEvent
+	attempts int
+	retry    time.Time
+}
+
 func (a *aggregator) runAggregate(ctx context.Context) error {
-	// pieces being aggregated, flushed upon commitment
-	// Invariant: the pieces in the pending queue can always make a valid aggregate w.r.t a.targetDealSize
-	pending := make([]DataReadyEvent, 0, 256)
-	total := uint64(0)
-	prefixPiece := filabi.PieceInfo{
-		Size:     filabi.PaddedPieceSize(prefixCARSizePadded),
-		PieceCID: cid.MustParse(prefixCARCid),
+	// Staging workers stop with aggregation
+	ctx, cancel := context.WithCancel(ctx)
+	defer a.stagingWG.Wait()
+	defer cancel()
+
+	// Offers from previous runs go back through the packing strategy first
+	// Every offer handed to the strategy is persisted in a.store so it survives restarts
+	for _, event := range a.pending {
+		if sealed := a.packing.Add(event); len(sealed) > 0 {
+			if err := a.commitSealed(ctx, sealed, 0); err != nil {
+				return err
+			}
+		}
 	}
+	a.observePending()
 
+	ticker := time.NewTicker(sealCheckInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			fmt.Printf("ctx done shutting down aggregation")
 			return nil
-		case latestEvent := <-a.ch:
-			// Check if the offer is too big to fit in a valid aggregate on its own
-			// TODO: as referenced below there must be a better way when we introspect on the gory details of NewAggregate
-			latestPiece, err := latestEvent.Offer.Piece()
-			if err != nil {
-				log.Printf("skipping offer %d, size %d not valid padded piece size ", latestEvent.OfferID, latestEvent.Offer.Size)
-				continue
+		case <-ticker.C:
+			if err := a.retryReverted(ctx); err != nil {
+				return err
+			}
+			if err := a.sealExpired(ctx); err != nil {
+				return err
 			}
-			_, err = datasegment.NewAggregate(filabi.PaddedPieceSize(a.targetDealSize), []filabi.PieceInfo{
-				prefixPiece,
-				latestPiece,
-			})
-			if err != nil {
-				log.Printf("error creating aggregate: %s", err)
-				log.Printf("skipping offer %d, size %d exceeds max PODSI packable size %d", latestEvent.OfferID, latestEvent.Offer.Size, a.targetDealSize)
+		case msg := <-a.ch:
+			if msg.retract {
+				if err := a.retractOffer(msg.event.OfferID); err != nil {
+					return err
+				}
 				continue
 			}
-			// TODO: in production we'll maybe want to move data from buffer before we commit to storing it.
-
-			// TODO: Unsorted greedy is a very naive knapsack strategy, production will want something better
-			// TODO: doing all the work of creating an aggregate for every new offer is quite wasteful
-			//      there must be a cheaper way to do this, but for now it is the most expediant without learning
-			//      all the gory edge cases in NewAggregate
-
-			// Turn offers into datasegment pieces
-			pieces := make([]filabi.PieceInfo, len(pending)+1)
-			for i, event := range pending {
-				piece, err := event.Offer.Piece()
-				if err != nil {
+			if msg.event == nil {
+				// Every offer sent before the cursor has been accepted, rejected or is staging
+				a.handled = max(a.handled, msg.cursor)
+				if err := a.advanceCursor(); err != nil {
 					return err
 				}
-				pieces[i] = piece
+				continue
+			}
+			latestEvent := *msg.event
+			// Check if the offer is too big to fit in a valid aggregate on its own
+			if _, err := latestEvent.Offer.Piece(); err != nil {
+				a.rejectOffer(latestEvent, rejectedValidation, fmt.Sprintf("size %d not valid padded piece size", latestEvent.Offer.Size))
+				continue
+			}
+			if !fitsAggregate(a.targetDealSize, []DataReadyEvent{latestEvent}) {
+				a.rejectOffer(latestEvent, rejectedValidation, fmt.Sprintf("size %d exceeds max PODSI packable size %d", latestEvent.Offer.Size, a.targetDealSize))
+				continue
+			}
+			// Keep a local copy so the aggregate can be transferred even if the
+			// buffer goes away, verifying the data hashes to the offered CommP
+			// so one bad offer cannot spoil a whole aggregate
+			a.startStaging(ctx, latestEvent)
+		case job := <-a.staged:
+			if err := a.finishStaging(ctx, job); err != nil {
+				return err
 			}
+		}
+	}
+}
 
-			pieces[len(pending)] = latestPiece
-			// aggregate
-			aggregatePieces := append([]filabi.PieceInfo{
-				prefixPiece,
-			}, pieces...)
-			_, err = datasegment.NewAggregate(filabi.PaddedPieceSize(a.targetDealSize), aggregatePieces)
-			if err != nil { // we've overshot, lets commit to just pieces in pending
-				total = 0
-				// Remove the latest offer which took us over
-				pieces = pieces[:len(pieces)-1]
-				aggregatePieces = aggregatePieces[:len(aggregatePieces)-1]
-				agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(a.targetDealSize), aggregatePieces)
-				if err != nil {
-					return fmt.Errorf("failed to create aggregate from pending, should not be reachable: %w", err)
-				}
+// Add a staged offer to the pending offers, sealing an aggregate if the
+// packing strategy says so
+func (a *aggregator) addPending(ctx context.Context, event DataReadyEvent) error {
+	event.Received = time.Now()
+	if err := a.store.PutPending(event); err != nil {
+		return fmt.Errorf("failed to persist pending offer %d: %w", event.OfferID, err)
+	}
+	if sealed := a.packing.Add(event); len(sealed) > 0 {
+		if err := a.commitSealed(ctx, sealed, 0); err != nil {
+			return err
+		}
+	}
+	pending := a.packing.Pending()
+	log.Printf("Offer %d added. %d offers pending aggregation with total size=%d\n", event.OfferID, len(pending), totalSize(pending))
+	a.observePending()
+	return nil
+}
 
-				inclProofs := make([]merkletree.ProofData, len(pieces))
-				ids := make([]uint64, len(pieces))
-				for i, piece := range pieces {
-					podsi, err := agg.ProofForPieceInfo(piece)
-					if err != nil {
-						return err
-					}
-					ids[i] = pending[i].OfferID
-					inclProofs[i] = podsi.ProofSubtree // Only do data proofs on chain for now not index proofs
-				}
-				aggCommp, err := agg.PieceCID()
-				if err != nil {
-					return err
-				}
-				tx, err := a.onramp.Transact(a.auth, "commitAggregate", aggCommp.Bytes(), ids, inclProofs, a.payoutAddr)
-				if err != nil {
-					return err
-				}
-				receipt, err := bind.WaitMined(ctx, a.client, tx)
-				if err != nil {
-					return err
-				}
-				log.Printf("Tx %s committing aggregate commp %s included: %d", tx.Hash().Hex(), aggCommp.String(), receipt.Status)
+// Persist the last block whose offers are all accepted or rejected. It stays
+// before the oldest offer still staging so a restart replays that offer.
+func (a *aggregator) advanceCursor() error {
+	block := a.handled
+	for _, job := range a.inflight {
+		if job.event.BlockNumber <= block {
+			block = max(job.event.BlockNumber, 1) - 1
+		}
+	}
+	if block <= a.cursor {
+		return nil
+	}
+	if err := a.store.SetCursor(block); err != nil {
+		return fmt.Errorf("failed to persist block cursor: %w", err)
+	}
+	a.cursor = block
+	return nil
+}
 
-				// Schedule aggregate data for transfer
-				// After adding to the map this is now served in aggregator.transferHandler at `/?id={transferID}`
-				locations := make([]string, len(pending))
-				for i, event := range pending {
-					locations[i] = event.Offer.Location
-				}
-				var transferID int
-				a.transferLk.Lock()
-				transferID = a.transferID
-				a.transfers[transferID] = AggregateTransfer{
-					locations: locations,
-					agg:       agg,
-				}
-				a.transferID++
-				a.transferLk.Unlock()
-				log.Printf("Transfer ID %d scheduled for aggregate %s", transferID, aggCommp.String())
+// Drop an offer removed from the chain before commitment so it is not aggregated
+func (a *aggregator) retractOffer(offerID uint64) error {
+	if job, ok := a.inflight[offerID]; ok {
+		// Its worker cleans up once it stops
+		job.cancel()
+		delete(a.inflight, offerID)
+		log.Printf("Offer %d retracted by reorg while staging\n", offerID)
+		return a.advanceCursor()
+	}
+	if !a.packing.Remove(offerID) && !a.removeReverted(offerID) {
+		log.Printf("[WARN] offer %d removed by reorg is not pending, it may already be committed", offerID)
+		return nil
+	}
+	if err := a.store.DeletePending(offerID); err != nil {
+		return fmt.Errorf("failed to delete retracted offer %d: %w", offerID, err)
+	}
+	if err := a.staging.Remove(offerID); err != nil {
+		log.Printf("failed to remove staged data of retracted offer %d: %s", offerID, err)
+	}
+	pending := a.packing.Pending()
+	log.Printf("Offer %d retracted by reorg. %d offers pending aggregation with total size=%d\n", offerID, len(pending), totalSize(pending))
+	a.observePending()
+	return nil
+}
 
-				err = a.sendDeal(ctx, aggCommp, transferID)
-				if err != nil {
-					log.Printf("[ERROR] failed to send deal: %s", err)
-				}
+// Record why an offer is not aggregated
+func (a *aggregator) rejectOffer(event DataReadyEvent, stage, reason string) {
+	log.Printf("skipping offer %d, %s", event.OfferID, reason)
+	offersRejected.WithLabelValues(stage).Inc()
+	rec := RejectedOffer{OfferID: event.OfferID, Offer: event.Offer, Reason: reason, Rejected: time.Now()}
+	if err := a.store.PutRejected(rec); err != nil {
+		log.Printf("[ERROR] failed to record rejection of offer %d: %s", event.OfferID, err)
+	}
+}
+
+// Seal whatever is pending once the oldest offer has waited longer than
+// a.maxWait so quiet deployments still make deals. The aggregate is padded
+// out to targetDealSize like any other.
+func (a *aggregator) sealExpired(ctx context.Context) error {
+	if a.maxWait == 0 {
+		return nil
+	}
+	pending := a.packing.Pending()
+	if len(pending) == 0 {
+		return nil
+	}
+	oldest := pending[0].Received
+	for _, event := range pending {
+		if event.Received.Before(oldest) {
+			oldest = event.Received
+		}
+	}
+	if time.Since(oldest) < a.maxWait {
+		return nil
+	}
+	fill := float64(totalSize(pending)) / float64(a.targetDealSize)
+	if fill < a.minFill {
+		log.Printf("Pending offers waited %s but only fill %.3f of the aggregate, need %.3f to seal", time.Since(oldest).Round(time.Second), fill, a.minFill)
+		return nil
+	}
+	sealed := a.packing.Flush()
+	if len(sealed) == 0 {
+		return nil
+	}
+	log.Printf("Sealing %d offers after waiting %s, fill %.3f", len(sealed), time.Since(oldest).Round(time.Second), float64(totalSize(sealed))/float64(a.targetDealSize))
+	defer a.observePending()
+	return a.commitSealed(ctx, sealed, 0)
+}
+
+// Commit sealed offers, holding them back for another attempt with backoff if
+// the commit reverts so one bad aggregate does not stop aggregation. Offers
+// are rejected once their aggregate reverted maxCommitAttempts times.
+func (a *aggregator) commitSealed(ctx context.Context, events []DataReadyEvent, attempts int) error {
+	err := a.sealAggregate(ctx, events)
+	if !errors.Is(err, errCommitReverted) {
+		return err
+	}
+	attempts++
+	if attempts >= maxCommitAttempts {
+		log.Printf("[ERROR] %s, giving up on its %d offers after %d attempts", err, len(events), attempts)
+		for _, event := range events {
+			if err := a.store.DeletePending(event.OfferID); err != nil {
+				return fmt.Errorf("failed to delete offer %d: %w", event.OfferID, err)
+			}
+			if err := a.staging.Remove(event.OfferID); err != nil {
+				log.Printf("failed to remove staged data of offer %d: %s", event.OfferID, err)
+			}
+			a.rejectOffer(event, rejectedCommit, err.Error())
+		}
+		return nil
+	}
+	delay := commitRetryMin << (attempts - 1)
+	log.Printf("[ERROR] %s, committing its %d offers again in %s", err, len(events), delay)
+	a.reverted = append(a.reverted, &revertedCommit{events: events, attempts: attempts, retry: time.Now().Add(delay)})
+	return nil
+}
 
-				// Reset queue to empty, add the event that triggered aggregation
-				pending = pending[:0]
-				pending = append(pending, latestEvent)
+// Commit the offers of reverted aggregates again once their backoff passed
+func (a *aggregator) retryReverted(ctx context.Context) error {
+	var due []*revertedCommit
+	waiting := a.reverted[:0]
+	for _, rc := range a.reverted {
+		if time.Now().Before(rc.retry) {
+			waiting = append(waiting, rc)
+		} else {
+			due = append(due, rc)
+		}
+	}
+	a.reverted = waiting
+	for _, rc := range due {
+		if err := a.commitSealed(ctx, rc.events, rc.attempts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			} else {
-				total += latestEvent.Offer.Size
-				pending = append(pending, latestEvent)
-				log.Printf("Offer %d added. %d offers pending aggregation with total size=%d\n", latestEvent.OfferID, len(pending), total)
+// Drop an offer from the aggregates waiting to be committed again
+func (a *aggregator) removeReverted(offerID uint64) bool {
+	for i, rc := range a.reverted {
+		for j, event := range rc.events {
+			if event.OfferID != offerID {
+				continue
 			}
+			rc.events = slices.Delete(rc.events, j, j+1)
+			if len(rc.events) == 0 {
+				a.reverted = slices.Delete(a.reverted, i, i+1)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Commit an aggregate of the given offers on chain, schedule its data for
+// transfer and send the deal
+func (a *aggregator) sealAggregate(ctx context.Context, events []DataReadyEvent) error {
+	events = aggregateOrder(events)
+	pieces := make([]filabi.PieceInfo, len(events))
+	for i, event := range events {
+		piece, err := event.Offer.Piece()
+		if err != nil {
+			return err
 		}
+		pieces[i] = piece
+	}
+	agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(a.targetDealSize), append([]filabi.PieceInfo{
+		prefixPiece,
+	}, pieces...))
+	if err != nil {
+		return fmt.Errorf("failed to create aggregate from pending, should not be reachable: %w", err)
+	}
+
+	inclProofs := make([]merkletree.ProofData, len(pieces))
+	ids := make([]uint64, len(pieces))
+	for i, piece := range pieces {
+		podsi, err := agg.ProofForPieceInfo(piece)
+		if err != nil {
+			return err
+		}
+		ids[i] = events[i].OfferID
+		inclProofs[i] = podsi.ProofSubtree // Only do data proofs on chain for now not index proofs
+	}
+	aggCommp, err := agg.PieceCID()
+	if err != nil {
+		return err
+	}
+	tx, err := a.onramp.Transact(a.auth, "commitAggregate", aggCommp.Bytes(), ids, inclProofs, a.payoutAddr)
+	if err != nil {
+		if isRevert(err) {
+			// Gas estimation executes the call and fails if it would revert
+			return fmt.Errorf("%w: committing aggregate %s: %s", errCommitReverted, aggCommp, err)
+		}
+		return err
+	}
+	receipt, err := bind.WaitMined(ctx, a.receipts, tx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Tx %s committing aggregate commp %s included: %d", tx.Hash().Hex(), aggCommp.String(), receipt.Status)
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		// The offers stay pending in the store until committed or rejected
+		return fmt.Errorf("%w: tx %s committing aggregate %s", errCommitReverted, tx.Hash().Hex(), aggCommp)
+	}
+	aggregatesCommitted.Inc()
+	commitGasUsed.Observe(float64(receipt.GasUsed))
+
+	// Schedule aggregate data for transfer
+	// After adding to the map this is now served in aggregator.transferHandler at `/?id={transferID}`
+	locations := make([]string, len(events))
+	for i, event := range events {
+		locations[i] = event.Offer.Location
+	}
+	transferID, err := a.store.CommitAggregate(&AggregateRecord{
+		CommP:     aggCommp,
+		DealSize:  a.targetDealSize,
+		Pieces:    pieces,
+		OfferIDs:  ids,
+		Locations: locations,
+		Committed: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to persist committed aggregate %s: %w", aggCommp, err)
+	}
+	a.transferLk.Lock()
+	a.transfers[transferID] = AggregateTransfer{
+		locations: locations,
+		offerIDs:  ids,
+		agg:       agg,
 	}
+	a.transferLk.Unlock()
+	log.Printf("Transfer ID %d scheduled for aggregate %s", transferID, aggCommp.String())
+
+	if err := a.proposeAggregate(ctx, aggCommp, transferID); err != nil {
+		log.Printf("[ERROR] failed to replicate aggregate: %s", err)
+	}
+	return nil
 }
 
-// Send deal data to the configured SP deal making address (boost node)
+// URL providers fetch an aggregate's data from
+func (a *aggregator) transferURL(transferID int) string {
+	return fmt.Sprintf("http://%s/?id=%d", a.transferAddr, transferID)
+}
+
+// Signature is unchecked since client is smart contract
+var contractSignature = crypto.Signature{
+	Type: crypto.SigTypeBLS,
+	Data: []byte{0xc0, 0xff, 0xee},
+}
+
+// Send deal data to the SP's deal making address (boost node)
 // The deal is made with the configured prover client contract
 // Heavily inspired by boost client
-func (a *aggregator) sendDeal(ctx context.Context, aggCommp cid.Cid, transferID int) error {
-	if err := a.host.Connect(ctx, *a.spDealAddr); err != nil {
-		return fmt.Errorf("failed to connect to peer %s: %w", a.spDealAddr.ID, err)
+func (a *aggregator) sendDeal(ctx context.Context, sp *storageProvider, aggCommp cid.Cid, transferID int) (DealRecord, error) {
+	deal := newDealRecord(sp, aggCommp, transferID)
+	if err := a.host.Connect(ctx, *sp.deal); err != nil {
+		return deal, fmt.Errorf("failed to connect to peer %s: %w", sp.deal.ID, err)
 	}
-	x, err := a.host.Peerstore().FirstSupportedProtocol(a.spDealAddr.ID, DealProtocolv120)
+	x, err := a.host.Peerstore().FirstSupportedProtocol(sp.deal.ID, DealProtocolv120)
 	if err != nil {
-		return fmt.Errorf("getting protocols for peer %s: %w", a.spDealAddr.ID, err)
+		return deal, fmt.Errorf("getting protocols for peer %s: %w", sp.deal.ID, err)
 	}
 	if len(x) == 0 {
-		return fmt.Errorf("cannot make a deal with storage provider %s because it does not support protocol version 1.2.0", a.spDealAddr.ID)
+		return deal, fmt.Errorf("cannot make a deal with storage provider %s because it does not support protocol version 1.2.0", sp.deal.ID)
 	}
 
 	// Construct deal
-	dealUuid := uuid.New()
-	log.Printf("making deal for commp %s, UUID=%s\n", aggCommp.String(), dealUuid)
+	log.Printf("making deal for commp %s, UUID=%s\n", aggCommp.String(), deal.UUID)
 	transferParams := boosttypes2.HttpRequest{
-		URL: fmt.Sprintf("http://%s/?id=%d", a.transferAddr, transferID),
+		URL: a.transferURL(transferID),
+		Headers: map[string]string{
+			"Authorization": "Bearer " + deal.TransferToken,
+		},
 	}
 	paramsBytes, err := json.Marshal(transferParams)
 	if err != nil {
-		return fmt.Errorf("failed to marshal transfer params: %w", err)
+		return deal, fmt.Errorf("failed to marshal transfer params: %w", err)
 	}
 	transfer := boosttypes.Transfer{
 		Type:     "http",
@@ -644,58 +1239,64 @@ func (a *aggregator) sendDeal(ctx context.Context, aggCommp cid.Cid, transferID
 		Size:     a.targetDealSize - a.targetDealSize/128, // aggregate for transfer is not fr32 encoded
 	}
 
-	bounds, err := a.lotusAPI.StateDealProviderCollateralBounds(ctx, filabi.PaddedPieceSize(a.targetDealSize), false, lotustypes.EmptyTSK)
+	filClient, err := address.NewDelegatedAddress(builtintypes.EthereumAddressManagerActorID, a.proverAddr[:])
 	if err != nil {
-		return fmt.Errorf("failed to get collateral bounds: %w", err)
+		return deal, fmt.Errorf("failed to translate onramp address (%s) into a "+
+			"Filecoin f4 address: %w", a.onrampAddr.Hex(), err)
 	}
-	providerCollateral := fbig.Div(fbig.Mul(bounds.Min, fbig.NewInt(6)), fbig.NewInt(5)) // add 20% as boost client does
-	tipset, err := a.lotusAPI.ChainHead(ctx)
+	verified, err := a.verifiedDeal(ctx, sp, filClient)
 	if err != nil {
-		return fmt.Errorf("cannot get chain head: %w", err)
+		return deal, err
 	}
-	filHeight := tipset.Height()
-	dealStart := filHeight + dealDelayEpochs
-	dealEnd := dealStart + dealDuration
-	filClient, err := address.NewDelegatedAddress(builtintypes.EthereumAddressManagerActorID, a.proverAddr[:])
+	deal.Verified = verified
+	bounds, err := a.lotusAPI.StateDealProviderCollateralBounds(ctx, filabi.PaddedPieceSize(a.targetDealSize), verified, lotustypes.EmptyTSK)
 	if err != nil {
-		return fmt.Errorf("failed to translate onramp address (%s) into a "+
-			"Filecoin f4 address: %w", a.onrampAddr.Hex(), err)
+		return deal, fmt.Errorf("failed to get collateral bounds: %w", err)
+	}
+	providerCollateral, err := sp.terms.collateral(bounds.Min, bounds.Max)
+	if err != nil {
+		return deal, err
 	}
+	tipset, err := a.lotusAPI.ChainHead(ctx)
+	if err != nil {
+		return deal, fmt.Errorf("cannot get chain head: %w", err)
+	}
+	filHeight := tipset.Height()
+	dealStart := filHeight + sp.terms.startDelay
+	dealEnd := dealStart + sp.terms.duration
+	deal.StartEpoch = dealStart
+	deal.EndEpoch = dealEnd
 	chainID, err := a.client.ChainID(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get chain ID: %w", err)
+		return deal, fmt.Errorf("failed to get chain ID: %w", err)
 	}
 	// Encode the chainID as uint256
 	encodedChainID, err := encodeChainID(chainID)
 	if err != nil {
-		return fmt.Errorf("failed to encode chainID: %w", err)
+		return deal, fmt.Errorf("failed to encode chainID: %w", err)
 	}
 	dealLabel, err := market.NewLabelFromBytes(encodedChainID)
 	if err != nil {
-		return fmt.Errorf("failed to create deal label: %w", err)
+		return deal, fmt.Errorf("failed to create deal label: %w", err)
 	}
 	proposal := market.ClientDealProposal{
 		Proposal: market.DealProposal{
 			PieceCID:             aggCommp,
 			PieceSize:            filabi.PaddedPieceSize(a.targetDealSize),
-			VerifiedDeal:         false,
+			VerifiedDeal:         verified,
 			Client:               filClient,
-			Provider:             a.spActorAddr,
+			Provider:             sp.actor,
 			StartEpoch:           dealStart,
 			EndEpoch:             dealEnd,
-			StoragePricePerEpoch: fbig.NewInt(0),
+			StoragePricePerEpoch: sp.terms.price,
 			ProviderCollateral:   providerCollateral,
 			Label:                dealLabel,
 		},
-		// Signature is unchecked since client is smart contract
-		ClientSignature: crypto.Signature{
-			Type: crypto.SigTypeBLS,
-			Data: []byte{0xc0, 0xff, 0xee},
-		},
+		ClientSignature: contractSignature,
 	}
 
 	dealParams := boosttypes.DealParams{
-		DealUUID:           dealUuid,
+		DealUUID:           deal.UUID,
 		ClientDealProposal: proposal,
 		DealDataRoot:       aggCommp,
 		IsOffline:          false,
@@ -704,20 +1305,20 @@ func (a *aggregator) sendDeal(ctx context.Context, aggCommp cid.Cid, transferID
 		SkipIPNIAnnounce:   false,
 	}
 
-	s, err := a.host.NewStream(ctx, a.spDealAddr.ID, DealProtocolv120)
+	s, err := a.host.NewStream(ctx, sp.deal.ID, DealProtocolv120)
 	if err != nil {
-		return err
+		return deal, err
 	}
 	defer s.Close()
 
 	var resp boosttypes.DealResponse
 	if err := doRpc(ctx, s, &dealParams, &resp); err != nil {
-		return fmt.Errorf("send proposal rpc: %w", err)
+		return deal, fmt.Errorf("send proposal rpc: %w", err)
 	}
 	if !resp.Accepted {
-		return fmt.Errorf("deal proposal rejected: %s", resp.Message)
+		return deal, fmt.Errorf("deal proposal rejected: %s", resp.Message)
 	}
-	return nil
+	return deal, nil
 }
 
 func doRpc(ctx context.Context, s inet.Stream, req interface{}, resp interface{}) error {
@@ -747,6 +1348,7 @@ func doRpc(ctx context.Context, s inet.Stream, req interface{}, resp interface{}
 // LazyHTTPReader is an io.Reader that fetches data from an HTTP URL on the first Read call
 type lazyHTTPReader struct {
 	url     string
+	offset  int64 // bytes to skip at the start of the data
 	reader  io.ReadCloser
 	started bool
 }
@@ -754,12 +1356,33 @@ type lazyHTTPReader struct {
 func (l *lazyHTTPReader) Read(p []byte) (int, error) {
 	if !l.started {
 		// Start the HTTP request on the first Read call
-		fmt.Printf("reading %s\n", l.url)
-		resp, err := http.Get(l.url)
+		req, err := http.NewRequest(http.MethodGet, l.url, nil)
 		if err != nil {
 			return 0, err
 		}
-		if resp.StatusCode != http.StatusOK {
+		if l.offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", l.offset))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fetchFailed(l.url)
+			return 0, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+			// Offset is past the end of the data
+			resp.Body.Close()
+			l.started = true
+			l.reader = io.NopCloser(bytes.NewReader(nil))
+			return 0, io.EOF
+		case resp.StatusCode == http.StatusOK && l.offset > 0:
+			// Server ignored the range, skip to the offset ourselves
+			if _, err := io.CopyN(io.Discard, resp.Body, l.offset); err != nil && err != io.EOF {
+				resp.Body.Close()
+				return 0, err
+			}
+		case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent:
+			fetchFailed(l.url)
 			resp.Body.Close()
 			return 0, fmt.Errorf("failed to fetch data: %s", resp.Status)
 		}
@@ -776,14 +1399,10 @@ func (l *lazyHTTPReader) Close() error {
 	return nil
 }
 
-// Handle data transfer requests from boost
+// Handle data transfer requests from boost. Range requests let an
+// interrupted transfer resume without refetching the whole aggregate.
 func (a *aggregator) transferHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.Itoa(int(a.targetDealSize-a.targetDealSize/128)))
-	if r.Method == "HEAD" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
 
 	idStr := r.URL.Query().Get("id")
 	if idStr == "" {
@@ -796,6 +1415,10 @@ func (a *aggregator) transferHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !a.authorizedTransfer(r, id) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 	a.transferLk.RLock()
 	transfer, ok := a.transfers[id]
 	a.transferLk.RUnlock()
@@ -803,70 +1426,142 @@ func (a *aggregator) transferHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "No data found", http.StatusNotFound)
 		return
 	}
-	// First write the CAR prefix to the response
-	prefixCARBytes, err := hex.DecodeString(prefixCAR)
-	if err != nil {
-		http.Error(w, "Failed to decode CAR prefix", http.StatusInternalServerError)
-		return
-	}
-
-	readers := []io.Reader{bytes.NewReader(prefixCARBytes)}
-	// Fetch each sub piece from its buffer location and write to response
-	for _, url := range transfer.locations {
-		lazyReader := &lazyHTTPReader{url: url}
-		readers = append(readers, lazyReader)
-		defer lazyReader.Close()
-	}
-	aggReader, err := transfer.agg.AggregateObjectReader(readers)
+	// Sub pieces are read from staging (or their buffer locations) as the requested range reaches them
+	aggReader, err := newAggregateReader(&transfer, a.staging)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("failed to create aggregate reader: %s", err), http.StatusInternalServerError)
 		return
 	}
-	_, err = io.Copy(w, aggReader)
-	if err != nil {
-		log.Printf("failed to write aggregate stream: %s", err)
-	}
+	defer aggReader.Close()
+	http.ServeContent(&countingWriter{ResponseWriter: w, counter: transferBytesServed}, r, "", time.Time{}, aggReader)
 }
 
 type AggregateTransfer struct {
 	locations []string
+	offerIDs  []uint64 // offers in the same order as locations
 	agg       *datasegment.Aggregate
 }
 
-func (a *aggregator) SubscribeQuery(ctx context.Context, query ethereum.FilterQuery) error {
-	logs := make(chan types.Log)
-	log.Printf("Listening for data ready events on %s\n", a.onrampAddr.Hex())
-	sub, err := a.client.SubscribeFilterLogs(ctx, query, logs)
+// Rebuild the transfer layout of a committed aggregate
+func (r *AggregateRecord) transfer() (AggregateTransfer, error) {
+	agg, err := datasegment.NewAggregate(filabi.PaddedPieceSize(r.DealSize), append([]filabi.PieceInfo{
+		prefixPiece,
+	}, r.Pieces...))
 	if err != nil {
-		return err
+		return AggregateTransfer{}, err
 	}
-	defer sub.Unsubscribe()
-LOOP:
-	for {
+	return AggregateTransfer{
+		locations: r.Locations,
+		offerIDs:  r.OfferIDs,
+		agg:       agg,
+	}, nil
+}
+
+// Resolve where log sources should start reading from: an explicit --from-block
+// replay, otherwise the last processed block
+func (a *aggregator) startBlock() (uint64, bool, error) {
+	if a.fromBlock != nil {
+		// Manual replay only applies to the first catch up, later restarts of the source resume from the cursor
+		from := *a.fromBlock
+		a.fromBlock = nil
+		return from, true, nil
+	}
+	return a.store.Cursor()
+}
+
+// errRetryLogs marks log handling failures that are retried by restarting the
+// log source from the cursor
+var errRetryLogs = errors.New("failed to handle logs")
+
+// How long to wait before restarting the log source after errRetryLogs
+const logRetryDelay = 30 * time.Second
+
+// Queue a DataReady log for confirmation, or retract it if it was removed by a reorg
+func (a *aggregator) handleLog(ctx context.Context, vLog types.Log) error {
+	if vLog.Removed {
+		if a.confirmations.Remove(vLog) {
+			log.Printf("Dropped unconfirmed DataReady log %s:%d removed by reorg\n", vLog.TxHash.Hex(), vLog.Index)
+			return nil
+		}
+		event, err := parseDataReadyEvent(vLog, a.abi)
+		if err != nil {
+			return err
+		}
+		// Allow the offer to be picked up again if its transaction is reincluded
+		delete(a.seen, event.OfferID)
+		log.Printf("Retracting offer %d removed by reorg\n", event.OfferID)
+		// Sent after the offer itself, even if aggregation has not reached it yet
 		select {
+		case a.ch <- aggregationMsg{event: event, retract: true}:
 		case <-ctx.Done():
-			break LOOP
-		case err := <-sub.Err():
+		}
+		return nil
+	}
+	a.confirmations.Add(vLog)
+	// The head is at least the block of the log we just received
+	return a.releaseConfirmed(ctx, vLog.BlockNumber)
+}
+
+// Pass DataReady logs that are confirmed at head to aggregation unless the offer was already seen
+func (a *aggregator) releaseConfirmed(ctx context.Context, head uint64) error {
+	released := a.confirmations.Release(head)
+	for i, vLog := range released {
+		event, err := parseDataReadyEvent(vLog, a.abi)
+		if err != nil {
 			return err
-		case vLog := <-logs:
-			event, err := parseDataReadyEvent(vLog, a.abi)
-			if err != nil {
-				return err
-			}
-			log.Printf("Sending offer %d for aggregation\n", event.OfferID)
-			// This is where we should make packing decisions.
-			// In the current prototype we accept all offers regardless
-			// of payment type, amount or duration
-			a.ch <- *event
+		}
+		if _, ok := a.seen[event.OfferID]; ok {
+			log.Printf("Skipping already seen offer %d\n", event.OfferID)
+			continue
+		}
+		sender, err := a.offerSender(ctx, vLog)
+		if err != nil {
+			// Without the sender the blocklist cannot be checked, hold the
+			// offer back without moving the cursor past it
+			a.confirmations.Requeue(released[i:])
+			return fmt.Errorf("%w: offer %d: %s", errRetryLogs, event.OfferID, err)
+		}
+		a.seen[event.OfferID] = struct{}{}
+		offersReceived.Inc()
+		if err := a.admission.admit(event.Offer, sender); err != nil {
+			a.rejectOffer(*event, rejectedAdmission, err.Error())
+			continue
+		}
+		log.Printf("Sending offer %d for aggregation\n", event.OfferID)
+		select {
+		case a.ch <- aggregationMsg{event: event}:
+		case <-ctx.Done():
+			return nil
 		}
 	}
+	// Sources read every log up to head before releasing it, so logs up to
+	// head - depth are handled once aggregation reaches this message,
+	// including rejected offers and blocks without any offers. The cursor
+	// block is read again on restart.
+	if head <= a.confirmations.depth {
+		return nil
+	}
+	select {
+	case a.ch <- aggregationMsg{cursor: head - a.confirmations.depth}:
+	case <-ctx.Done():
+	}
 	return nil
 }
 
+// aggregationMsg passes work from log handling to aggregation, messages are
+// handled in the order they are sent
+type aggregationMsg struct {
+	event   *DataReadyEvent // confirmed offer to aggregate
+	retract bool            // the event was removed by a reorg instead
+	cursor  uint64          // without an event, last block whose logs are fully handled
+}
+
 // Define a Go struct to match the DataReady event from the OnRamp contract
 type DataReadyEvent struct {
-	Offer   Offer
-	OfferID uint64
+	Offer       Offer
+	OfferID     uint64
+	BlockNumber uint64    // block the event was emitted in, not part of the contract event
+	Received    time.Time // when the aggregator accepted the offer, not part of the contract event
 }
 
 // Function to parse the DataReady event from log data
@@ -899,8 +1594,9 @@ func parseDataReadyEvent(log types.Log, abi *abi.ABI) (*DataReadyEvent, error) {
 	}
 
 	return &DataReadyEvent{
-		OfferID: offerID,
-		Offer:   offer,
+		OfferID:     offerID,
+		Offer:       offer,
+		BlockNumber: log.BlockNumber,
 	}, nil
 }
 
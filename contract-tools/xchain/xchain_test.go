@@ -5,11 +5,23 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // Test function to test chainID encoding
@@ -79,4 +91,380 @@ func decodeChainID(data []byte) (*big.Int, error) {
     }
 
     return chainID, nil
-}
\ No newline at end of file
+}
+
+// DataReady event of OnRamp.sol
+const testDataReadyABI = `[{"type":"event","name":"DataReady","inputs":[
+	{"name":"offer","type":"tuple","components":[
+		{"name":"commP","type":"bytes"},
+		{"name":"size","type":"uint64"},
+		{"name":"location","type":"string"},
+		{"name":"amount","type":"uint256"},
+		{"name":"token","type":"address"}]},
+	{"name":"id","type":"uint64"}]}]`
+
+// DataReady log emitted for an offer in the given block
+func testDataReadyLog(t *testing.T, parsed *abi.ABI, block uint64, event DataReadyEvent) types.Log {
+	offer := event.Offer
+	if offer.Amount == nil {
+		offer.Amount = big.NewInt(0)
+	}
+	data, err := parsed.Events["DataReady"].Inputs.Pack(offer, event.OfferID)
+	require.NoError(t, err)
+	vLog := testLog(block, uint(event.OfferID))
+	vLog.Data = data
+	return vLog
+}
+
+// Aggregator running log handling and aggregation against the store at path,
+// with a deal size too big for any test offers to seal an aggregate
+func testAggregator(t *testing.T, path string, policy AdmissionPolicy) *aggregator {
+	parsed, err := abi.JSON(strings.NewReader(testDataReadyABI))
+	require.NoError(t, err)
+	store, err := OpenStateStore(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	staging, err := newStagingArea(filepath.Join(filepath.Dir(path), "staging"), 0)
+	require.NoError(t, err)
+	admission, err := policy.validate()
+	require.NoError(t, err)
+	packing, err := NewPackingStrategy(&Config{TargetAggSize: 1 << 30})
+	require.NoError(t, err)
+	return &aggregator{
+		abi:            &parsed,
+		ch:             make(chan aggregationMsg, 1024),
+		confirmations:  newConfirmationQueue(0),
+		transfers:      make(map[int]AggregateTransfer),
+		transferTokens: make(map[string]int),
+		staging:        staging,
+		staged:         make(chan *stagingJob),
+		inflight:       make(map[uint64]*stagingJob),
+		admission:      admission,
+		targetDealSize: 1 << 30,
+		store:          store,
+		packing:        packing,
+		seen:           make(map[uint64]struct{}),
+	}
+}
+
+func TestCursorAdvancesWithoutAcceptedOffers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	a := testAggregator(t, path, AdmissionPolicy{MaxPieceSize: 1 << 10})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.runAggregate(ctx) }()
+
+	// An offer rejected by admission and a block without offers
+	rejected := testOfferEvent(t, 1, "http://buffer.test/piece", 1<<20, []byte("too big"))
+	require.NoError(t, a.handleLog(ctx, testDataReadyLog(t, a.abi, 100, rejected)))
+	require.NoError(t, a.releaseConfirmed(ctx, 120))
+	waitForCursor(t, a, 120)
+	cancel()
+	require.NoError(t, <-done)
+	require.NoError(t, a.store.Close())
+
+	// Restarting resumes from the cursor instead of the chain head
+	a = testAggregator(t, path, AdmissionPolicy{})
+	from, ok, err := a.startBlock()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(120), from)
+	rejections, err := a.store.Rejected()
+	require.NoError(t, err)
+	require.Len(t, rejections, 1)
+	assert.Equal(t, uint64(1), rejections[0].OfferID)
+}
+
+func TestOfferSenderFailureRetriesOffer(t *testing.T) {
+	rpc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer rpc.Close()
+	spammer := common.HexToAddress("0x3333333333333333333333333333333333333333")
+	a := testAggregator(t, filepath.Join(t.TempDir(), "state.db"), AdmissionPolicy{BlockedSenders: []string{spammer.Hex()}})
+	client, err := ethclient.Dial(rpc.URL)
+	require.NoError(t, err)
+	defer client.Close()
+	a.client = client
+	a.confirmations = newConfirmationQueue(1)
+	ctx := context.Background()
+
+	// The offer is neither rejected nor released while its sender is unknown
+	event := testOfferEvent(t, 1, "http://buffer.test/piece", 128, []byte("data"))
+	require.NoError(t, a.handleLog(ctx, testDataReadyLog(t, a.abi, 100, event)))
+	assert.Equal(t, uint64(99), (<-a.ch).cursor)
+	err = a.releaseConfirmed(ctx, 101)
+	assert.ErrorIs(t, err, errRetryLogs)
+	assert.Empty(t, a.ch)
+	assert.Equal(t, 1, a.confirmations.Len())
+	rejections, err := a.store.Rejected()
+	require.NoError(t, err)
+	assert.Empty(t, rejections)
+
+	// and is released once the sender can be checked
+	a.admission, err = AdmissionPolicy{}.validate()
+	require.NoError(t, err)
+	require.NoError(t, a.releaseConfirmed(ctx, 101))
+	require.Len(t, a.ch, 2)
+	msg := <-a.ch
+	require.NotNil(t, msg.event)
+	assert.Equal(t, uint64(1), msg.event.OfferID)
+}
+
+// Wait until aggregation has handled everything sent before the cursor
+func waitForCursor(t *testing.T, a *aggregator, block uint64) {
+	require.Eventually(t, func() bool {
+		cursor, ok, err := a.store.Cursor()
+		return err == nil && ok && cursor >= block
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRetractQueuedOffer(t *testing.T) {
+	data := []byte("reorged out")
+	// Staging only ends when the retraction cancels it
+	buffer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer buffer.Close()
+	a := testAggregator(t, filepath.Join(t.TempDir(), "state.db"), AdmissionPolicy{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The offer is confirmed and removed by a reorg before aggregation gets to it
+	event := testOfferEvent(t, 1, buffer.URL, 128, data)
+	vLog := testDataReadyLog(t, a.abi, 100, event)
+	require.NoError(t, a.handleLog(ctx, vLog))
+	vLog.Removed = true
+	require.NoError(t, a.handleLog(ctx, vLog))
+	require.NoError(t, a.releaseConfirmed(ctx, 101))
+
+	done := make(chan error)
+	go func() { done <- a.runAggregate(ctx) }()
+	waitForCursor(t, a, 101)
+	cancel()
+	require.NoError(t, <-done)
+
+	assert.Empty(t, a.packing.Pending())
+	pending, err := a.store.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	assert.False(t, a.staging.Has(1))
+}
+
+func TestStagingDoesNotBlockAggregation(t *testing.T) {
+	hung := make(chan struct{})
+	buffer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-hung
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer buffer.Close()
+	a := testAggregator(t, filepath.Join(t.TempDir(), "state.db"), AdmissionPolicy{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- a.runAggregate(ctx) }()
+
+	slow := testOfferEvent(t, 1, buffer.URL+"/slow", 128, []byte("/slow"))
+	fast := testOfferEvent(t, 2, buffer.URL+"/fast", 128, []byte("/fast"))
+	require.NoError(t, a.handleLog(ctx, testDataReadyLog(t, a.abi, 100, slow)))
+	require.NoError(t, a.handleLog(ctx, testDataReadyLog(t, a.abi, 101, fast)))
+	require.NoError(t, a.releaseConfirmed(ctx, 110))
+
+	// The later offer is accepted while the earlier one is still downloading,
+	// and the cursor stays before the earlier one so a restart replays it
+	require.Eventually(t, func() bool {
+		pending, err := a.store.Pending()
+		return err == nil && len(pending) == 1 && pending[0].OfferID == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	waitForCursor(t, a, 99)
+	cursor, _, err := a.store.Cursor()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(99), cursor)
+
+	close(hung)
+	waitForCursor(t, a, 110)
+	pending, err := a.store.Pending()
+	require.NoError(t, err)
+	assert.Len(t, pending, 2)
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestStagingRetriesTemporaryFailures(t *testing.T) {
+	data := []byte("eventually available")
+	var requests atomic.Int32
+	buffer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(data)
+	}))
+	defer buffer.Close()
+	a := testAggregator(t, filepath.Join(t.TempDir(), "state.db"), AdmissionPolicy{})
+	a.staging.retryMin = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- a.runAggregate(ctx) }()
+
+	require.NoError(t, a.handleLog(ctx, testDataReadyLog(t, a.abi, 100, testOfferEvent(t, 1, buffer.URL, 128, data))))
+	require.NoError(t, a.releaseConfirmed(ctx, 101))
+	waitForCursor(t, a, 101)
+	cancel()
+	require.NoError(t, <-done)
+
+	assert.Equal(t, int32(3), requests.Load())
+	pending, err := a.store.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, uint64(1), pending[0].OfferID)
+	rejections, err := a.store.Rejected()
+	require.NoError(t, err)
+	assert.Empty(t, rejections)
+}
+
+func TestStagingRejectsMismatchedData(t *testing.T) {
+	buffer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not what was offered"))
+	}))
+	defer buffer.Close()
+	a := testAggregator(t, filepath.Join(t.TempDir(), "state.db"), AdmissionPolicy{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- a.runAggregate(ctx) }()
+
+	event := testOfferEvent(t, 1, buffer.URL, 128, []byte("what was offered"))
+	require.NoError(t, a.handleLog(ctx, testDataReadyLog(t, a.abi, 100, event)))
+	require.NoError(t, a.releaseConfirmed(ctx, 101))
+	waitForCursor(t, a, 101)
+	cancel()
+	require.NoError(t, <-done)
+
+	pending, err := a.store.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	rejections, err := a.store.Rejected()
+	require.NoError(t, err)
+	require.Len(t, rejections, 1)
+	assert.Contains(t, rejections[0].Reason, "CommP")
+	assert.False(t, a.staging.Has(1))
+}
+
+const testCommitAggregateABI = `[{"type":"function","name":"commitAggregate","stateMutability":"nonpayable","outputs":[],"inputs":[
+	{"name":"aggregate","type":"bytes"},
+	{"name":"claimedIDs","type":"uint64[]"},
+	{"name":"inclusionProofs","type":"tuple[]","components":[
+		{"name":"index","type":"uint64"},
+		{"name":"path","type":"bytes32[]"}]},
+	{"name":"payoutAddr","type":"address"}]}]`
+
+// fakeChain accepts every transaction and mines them with the given statuses in order
+type fakeChain struct {
+	bind.ContractTransactor
+	statuses []uint64
+	sent     []common.Hash
+}
+
+func (f *fakeChain) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	f.sent = append(f.sent, tx.Hash())
+	return nil
+}
+
+func (f *fakeChain) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return uint64(len(f.sent)), nil
+}
+
+func (f *fakeChain) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	for i, hash := range f.sent {
+		if hash == txHash {
+			return &types.Receipt{Status: f.statuses[i], TxHash: txHash}, nil
+		}
+	}
+	return nil, ethereum.NotFound
+}
+
+func (f *fakeChain) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	return []byte{1}, nil
+}
+
+// Send commitAggregate transactions of a to chain
+func testCommitter(t *testing.T, a *aggregator, chain *fakeChain) {
+	parsed, err := abi.JSON(strings.NewReader(testCommitAggregateABI))
+	require.NoError(t, err)
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	a.auth, err = bind.NewKeyedTransactorWithChainID(key, big.NewInt(314))
+	require.NoError(t, err)
+	// Skip the estimates the fake chain cannot answer
+	a.auth.GasPrice = big.NewInt(1)
+	a.auth.GasLimit = 1_000_000
+	a.onramp = bind.NewBoundContract(common.Address{}, parsed, nil, chain, nil)
+	a.receipts = chain
+}
+
+func TestRevertedCommitKeepsAggregating(t *testing.T) {
+	a := testAggregator(t, filepath.Join(t.TempDir(), "state.db"), AdmissionPolicy{})
+	chain := &fakeChain{statuses: []uint64{types.ReceiptStatusFailed, types.ReceiptStatusSuccessful}}
+	testCommitter(t, a, chain)
+	ctx := context.Background()
+
+	events := []DataReadyEvent{
+		testOfferEvent(t, 1, "http://buffer.test/1", 128, []byte("first")),
+		testOfferEvent(t, 2, "http://buffer.test/2", 128, []byte("second")),
+	}
+	for _, event := range events {
+		require.NoError(t, a.store.PutPending(event))
+	}
+
+	// A revert leaves the offers pending instead of stopping aggregation
+	require.NoError(t, a.commitSealed(ctx, events, 0))
+	require.Len(t, a.reverted, 1)
+	pending, err := a.store.Pending()
+	require.NoError(t, err)
+	assert.Len(t, pending, 2)
+	recs, err := a.store.Aggregates()
+	require.NoError(t, err)
+	assert.Empty(t, recs)
+
+	// and they are committed again once the backoff passed
+	require.NoError(t, a.retryReverted(ctx))
+	assert.Len(t, chain.sent, 1)
+	a.reverted[0].retry = time.Now()
+	require.NoError(t, a.retryReverted(ctx))
+	assert.Len(t, chain.sent, 2)
+	assert.Empty(t, a.reverted)
+	recs, err = a.store.Aggregates()
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	assert.ElementsMatch(t, []uint64{1, 2}, recs[0].OfferIDs)
+}
+
+func TestRevertedCommitRejectsOffersEventually(t *testing.T) {
+	a := testAggregator(t, filepath.Join(t.TempDir(), "state.db"), AdmissionPolicy{})
+	chain := &fakeChain{}
+	for i := 0; i < maxCommitAttempts; i++ {
+		chain.statuses = append(chain.statuses, types.ReceiptStatusFailed)
+	}
+	testCommitter(t, a, chain)
+	ctx := context.Background()
+	event := testOfferEvent(t, 1, "http://buffer.test/1", 128, []byte("always reverts"))
+	require.NoError(t, a.store.PutPending(event))
+
+	require.NoError(t, a.commitSealed(ctx, []DataReadyEvent{event}, 0))
+	for len(a.reverted) > 0 {
+		a.reverted[0].retry = time.Now()
+		require.NoError(t, a.retryReverted(ctx))
+	}
+	assert.Len(t, chain.sent, maxCommitAttempts)
+	pending, err := a.store.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	rejections, err := a.store.Rejected()
+	require.NoError(t, err)
+	require.Len(t, rejections, 1)
+	assert.Contains(t, rejections[0].Reason, "commit reverted")
+}